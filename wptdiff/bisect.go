@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// findTest returns the test by name, nil if missing.
+func findTest(tcs []*TestCase, name string) *TestCase {
+	for _, tc := range tcs {
+		if tc.Name == name {
+			return tc
+		}
+	}
+	return nil
+}
+
+// changed returns true if the test result differs between the two runs.
+func changed(last, prev *TestCase) bool {
+	if last == nil || prev == nil {
+		return last != prev
+	}
+	eq, _ := eql(last, prev)
+	return !eq
+}
+
+// runBisect implements the bisect sub command.
+func runBisect(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+	flags.SetOutput(stderr)
+
+	var (
+		source = flags.String("source", perfURL, "runs source: http base URL or local store directory")
+		n      = flags.Int("n", 10, "number of runs to scan up to -to when -from is missing, 0 for all")
+		from   = flags.String("from", "", "commit of the first run to scan, default to the first of the n runs")
+		to     = flags.String("to", "", "commit of the last run to scan, default to the last run")
+	)
+
+	bin := args[0]
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: %s bisect [-n <runs>] [-from <commit>] [-to <commit>] <test>\n", bin)
+		fmt.Fprintf(stderr, "Find the first run changing the result of a WPT test\n")
+		fmt.Fprintf(stderr, "\nCommand line options:\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("bad arguments")
+	}
+	name := flags.Arg(0)
+
+	cli := NewSource(*source)
+
+	runs, err := cli.FetchHistory(ctx)
+	if err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+
+	// Select the runs to scan. The commits are resolved in the whole
+	// history, -n only applies without -from.
+	start, end := -1, -1
+	for i, run := range runs {
+		if *from != "" && strings.HasPrefix(string(run.Commit), *from) {
+			start = i
+		}
+		if *to != "" && strings.HasPrefix(string(run.Commit), *to) {
+			end = i
+		}
+	}
+	if (*from != "" && start < 0) || (*to != "" && end < 0) {
+		return fmt.Errorf("invalid commits")
+	}
+	if end < 0 {
+		end = len(runs) - 1
+	}
+	if start < 0 {
+		start = 0
+		if *n > 0 {
+			start = max(0, end-*n+1)
+		}
+	}
+	if end-start < 1 {
+		return fmt.Errorf("not enough runs to scan: %d", end-start+1)
+	}
+	runs = runs[start : end+1]
+
+	fmt.Fprintf(stdout, "%s\n", name)
+
+	var prev *TestCase
+	for i, run := range runs {
+		slog.Debug("fetch", slog.Any("commit", run.Commit), slog.Time("date", run.Date))
+		tcs, err := cli.Fetch(ctx, run.Date, run.Commit)
+		if err != nil {
+			return fmt.Errorf("fetch %v: %w", run.Commit, err)
+		}
+
+		tc := findTest(tcs, name)
+		fmt.Fprintf(stdout, "%s %10s\t%v\t%s\n",
+			tcf(tc), sub(tc), run.Commit, run.Date.Format("2006-01-02 15:04"),
+		)
+
+		if i > 0 && changed(tc, prev) {
+			before := runs[i-1]
+			fmt.Fprintf(stdout, "\n")
+			fmt.Fprintf(stdout, "Changed between %v and %v\n", before.Commit, run.Commit)
+			fmt.Fprintf(stdout, "https://github.com/lightpanda-io/browser/compare/%v...%v\n",
+				before.Commit, run.Commit,
+			)
+			writeSubDiffs(stdout, DiffSubCases(tc, prev))
+			return nil
+		}
+
+		prev = tc
+	}
+
+	return fmt.Errorf("test %s unchanged in the %d runs", name, len(runs))
+}
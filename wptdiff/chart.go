@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+)
+
+var colors = []color.RGBA{
+	{R: 31, G: 119, B: 180, A: 255},  // Blue
+	{R: 255, G: 127, B: 14, A: 255},  // Orange
+	{R: 44, G: 160, B: 44, A: 255},   // Green
+	{R: 214, G: 39, B: 40, A: 255},   // Red
+	{R: 148, G: 103, B: 189, A: 255}, // Purple
+	{R: 140, G: 86, B: 75, A: 255},   // Brown
+	{R: 227, G: 119, B: 194, A: 255}, // Pink
+	{R: 127, G: 127, B: 127, A: 255}, // Gray
+}
+
+// saveTrendChart renders the pass count time series of the trends in a PNG
+// file, one line per trend.
+func saveTrendChart(name string, trends []*Trend) error {
+	p := plot.New()
+	p.Title.Text = "WPT pass count"
+	p.X.Label.Text = "Runs"
+	p.Y.Label.Text = "Passing sub cases"
+
+	for i, t := range trends {
+		xys := make(plotter.XYs, 0, len(t.Pass))
+		for run, pass := range t.Pass {
+			if t.Outcomes[run] == "" {
+				// missing from the run.
+				continue
+			}
+			xys = append(xys, plotter.XY{X: float64(run), Y: float64(pass)})
+		}
+
+		line, err := plotter.NewLine(xys)
+		if err != nil {
+			return fmt.Errorf("line %s: %w", t.Name, err)
+		}
+		line.Color = colors[i%len(colors)]
+		line.Width = vg.Points(1.5)
+		p.Add(line)
+		p.Legend.Add(t.Name, line)
+	}
+
+	p.Legend.Top = true
+	p.Legend.Left = true
+
+	return p.Save(12*vg.Inch, 6*vg.Inch, name)
+}
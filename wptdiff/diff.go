@@ -1,20 +1,26 @@
 package main
 
-import "log/slog"
-
 type Diff struct {
 	Name       string
 	Regression bool
 	Last       *TestCase
 	Prev       *TestCase
+	// Cases are the changes of the sub cases.
+	Cases []SubDiff
 }
 
-// Diff returns the test cases including a different result
+// Diff returns the test cases including a different result, from both runs.
+// The sub cases messages changes are listed too, they don't make a
+// regression.
 func ListDiff(last, prev []*TestCase) []Diff {
 	mlast := make(map[string]*TestCase)
 	for _, tc := range last {
 		mlast[tc.Name] = tc
 	}
+	mprev := make(map[string]*TestCase)
+	for _, tc := range prev {
+		mprev[tc.Name] = tc
+	}
 
 	var diff []Diff
 	for _, ptc := range prev {
@@ -25,50 +31,67 @@ func ListDiff(last, prev []*TestCase) []Diff {
 				Name:       ptc.Name,
 				Regression: true,
 				Prev:       ptc, Last: nil,
+				Cases: DiffSubCases(nil, ptc),
 			})
 			continue
 		}
 
 		eq, r := eql(ltc, ptc)
+		cases := DiffSubCases(ltc, ptc)
 
-		if !eq {
+		if !eq || len(cases) > 0 {
 			diff = append(diff, Diff{
 				Name:       ptc.Name,
 				Regression: r,
 				Prev:       ptc, Last: ltc,
+				Cases: cases,
 			})
 		}
 
 	}
 
+	for _, ltc := range last {
+		if _, ok := mprev[ltc.Name]; !ok {
+			// the last test case is new.
+			diff = append(diff, Diff{
+				Name: ltc.Name,
+				Prev: nil, Last: ltc,
+				Cases: DiffSubCases(ltc, nil),
+			})
+		}
+	}
+
 	return diff
 
 }
 
 // return equality and if a is a regression against b
 func eql(last, prev *TestCase) (bool, bool) {
-	if last.Pass != prev.Pass || last.Crash != prev.Crash {
+	if last.Pass != prev.Pass || last.Crash != prev.Crash || last.OOM != prev.OOM {
 		return false, !last.Pass || last.Crash
 	}
 
-	if len(last.SubCases) != len(prev.SubCases) {
-		return false, len(prev.SubCases) > len(last.SubCases)
+	// Old runs don't record the status, compare it only when both have it.
+	if last.Status != "" && prev.Status != "" && last.Status != prev.Status {
+		return false, !last.Pass
 	}
 
-	for i := range last.SubCases {
-		last, prev := last.SubCases[i], prev.SubCases[i]
-		if prev.Name != last.Name {
-			slog.Debug(
-				"test case subcases mismatch",
-				slog.String("test", last.Name), slog.Int("index", i),
-				slog.String("prev", prev.Name), slog.String("last", last.Name),
-			)
-		}
-		eq, r := eql(last, prev)
-		if !eq {
-			return false, r
+	// The sub cases are matched by name, a message change alone doesn't
+	// make the test different.
+	eq, regression := true, false
+	for _, d := range DiffSubCases(last, prev) {
+		switch d.Change {
+		case ChangeMessage:
+			continue
+		case ChangeRemoved, ChangeFail:
+			regression = true
+		case ChangeStatus:
+			regression = regression || !d.Last.Pass
+		case ChangeRenamed:
+			regression = regression || (d.Prev.Pass && !d.Last.Pass)
 		}
+		eq = false
 	}
 
-	return true, false
+	return eq, regression
 }
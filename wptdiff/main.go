@@ -37,6 +37,20 @@ const (
 )
 
 func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	// dispatch sub commands.
+	if len(args) > 1 {
+		switch args[1] {
+		case "merge":
+			return runMerge(ctx, args[1:], stdout, stderr)
+		case "import":
+			return runImport(ctx, args[1:], stdout, stderr)
+		case "trend":
+			return runTrend(ctx, args[1:], stdout, stderr)
+		case "bisect":
+			return runBisect(ctx, args[1:], stdout, stderr)
+		}
+	}
+
 	// declare runtime flag parameters.
 	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
 	flags.SetOutput(stderr)
@@ -46,17 +60,24 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 		list    = flags.Bool("list", false, "list available commits")
 		n       = flags.Int("n", 10, "number of runs to list, 0 for all")
 		local   = flags.String("local", "", "path to a local run")
+		source  = flags.String("source", perfURL, "runs source: http base URL or local store directory")
 
 		progress = flags.Bool("with-progress", false, "display regression and progression")
 		explain  = flags.String("explain", "", "Explain the difference in details for a given test")
 
 		completion = flags.Bool("completion", false, "Display completion summary")
+		subtests   = flags.Bool("subtests", false, "display the sub cases changes of each test")
+		jsonOut    = flags.Bool("json", false, "output the diff with the sub cases changes in JSON")
 	)
 
 	// usage func declaration.
 	bin := args[0]
 	flags.Usage = func() {
 		fmt.Fprintf(stderr, "usage: %s [<prev commit> [<last commit>]]\n", bin)
+		fmt.Fprintf(stderr, "       %s merge [-o <output>] <run.json>...\n", bin)
+		fmt.Fprintf(stderr, "       %s import -source <dir> -commit <commit> [-date <date>] <run.json>\n", bin)
+		fmt.Fprintf(stderr, "       %s trend [-n <runs>] [-dir] [-filter <prefix>] [-csv <file>] [-png <file>]\n", bin)
+		fmt.Fprintf(stderr, "       %s bisect [-n <runs>] [-from <commit>] [-to <commit>] <test>\n", bin)
 		fmt.Fprintf(stderr, "Compare WPT test results\n")
 		fmt.Fprintf(stderr, "\nCommand line options:\n")
 		flags.PrintDefaults()
@@ -75,7 +96,7 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 		return fmt.Errorf("bad arguments")
 	}
 
-	cli := NewClient(perfURL)
+	cli := NewSource(*source)
 
 	// fetch the history list
 	runs, err := cli.FetchHistory(ctx)
@@ -89,11 +110,17 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 
 	nruns := len(runs)
 
+	// recent are the n last runs.
+	recent := runs
+	if *n > 0 && *n < nruns {
+		recent = runs[nruns-*n:]
+	}
+
 	if *list {
-		for _, run := range runs[nruns-*n:] {
-			fmt.Fprintf(stdout, "%s\tP %s\tF %s\tC %s\t%v\n",
+		for _, run := range recent {
+			fmt.Fprintf(stdout, "%s\tP %s\tF %s\tC %s\tO %s\t%v\n",
 				run.Date.Format("2006-01-02 15:04"),
-				intf(run.Summary.Pass), intf(run.Summary.Fail), intf(run.Summary.Crash),
+				intf(run.Summary.Pass), intf(run.Summary.Fail), intf(run.Summary.Crash), intf(run.Summary.OOM),
 				run.Commit,
 			)
 		}
@@ -103,19 +130,22 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 	// Select the runs to compare.
 	// Use user's arguments or default to the 2 last ones.
 	var last, prev Run
+	if nruns < 2 {
+		return fmt.Errorf("not enough runs to compare: %d", nruns)
+	}
 	switch len(args) {
 	case 0:
 		last, prev = runs[nruns-1], runs[nruns-2]
 	case 1:
 		last = runs[nruns-1]
-		for _, run := range runs[nruns-*n:] {
+		for _, run := range recent {
 			if strings.HasPrefix(string(run.Commit), args[0]) {
 				prev = run
 				break
 			}
 		}
 	case 2:
-		for _, run := range runs[nruns-*n:] {
+		for _, run := range recent {
 			if strings.HasPrefix(string(run.Commit), args[0]) {
 				prev = run
 			}
@@ -161,6 +191,22 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 		return fmt.Errorf("fetch prev: %w", err)
 	}
 
+	diff := ListDiff(lasttcs, prevtcs)
+
+	if *jsonOut {
+		// By default keep only regressions
+		if !*progress {
+			var regressions []Diff
+			for _, d := range diff {
+				if d.Regression {
+					regressions = append(regressions, d)
+				}
+			}
+			diff = regressions
+		}
+		return writeJSONDiffs(stdout, prev, last, diff)
+	}
+
 	// Display headers
 	fmt.Fprintf(stdout, "Prev %v\t%s\n", prev.Commit, prev.Date.Format("2006-01-02 15:04"))
 	fmt.Fprintf(stdout, "Last %v\t%s\n", last.Commit, last.Date.Format("2006-01-02 15:04"))
@@ -169,19 +215,19 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 	)
 	fmt.Fprintf(stdout, "\n")
 
-	diff := ListDiff(lasttcs, prevtcs)
-
 	// If we want the details for a given test.
 	if *explain != "" {
 		for _, d := range diff {
 			if d.Name == *explain {
 				fmt.Fprintf(stdout, "%s\n", d.Name)
 
-				{
+				if d.Prev != nil {
 					tc := d.Prev
 					fmt.Fprintf(stdout, "%s %10s\t%-60s\t%d\n",
 						tcf(tc), sub(tc), tc.Message, tc.Elapsed,
 					)
+				} else {
+					fmt.Fprintf(stdout, "%s\t%s\n", tcf(d.Prev), d.Name)
 				}
 
 				if d.Last != nil {
@@ -201,6 +247,9 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 					fmt.Fprintf(stdout, "%s\t%s\n", tcf(d.Last), d.Name)
 				}
 
+				fmt.Fprintf(stdout, "=== Sub cases changes\n")
+				writeSubDiffs(stdout, d.Cases)
+
 				return nil
 			}
 		}
@@ -228,12 +277,19 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 			tcf(d.Last), sub(d.Last),
 			d.Name,
 		)
+		if *subtests {
+			writeSubDiffs(stdout, d.Cases)
+		}
 	}
 
 	return nil
 }
 
 func sub(tc *TestCase) string {
+	if tc == nil {
+		return "-"
+	}
+
 	n := 0
 	for _, s := range tc.SubCases {
 		if s.Pass {
@@ -251,10 +307,22 @@ func tcf(tc *TestCase) string {
 	if tc.Pass {
 		return "P"
 	}
+	if tc.OOM {
+		return "O"
+	}
 	if tc.Crash {
 		return "C"
 	}
 
+	switch tc.Status {
+	case "Timeout":
+		return "T"
+	case "Not Run":
+		return "N"
+	case "Optional Feature Unsupported":
+		return "U"
+	}
+
 	return "F"
 }
 
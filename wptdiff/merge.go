@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Summary counts the tests of a run by outcome, as in the history file.
+type Summary struct {
+	Pass  int `json:"pass"`
+	Fail  int `json:"fail"`
+	Crash int `json:"crash"`
+	// OOM counts the crashes caused by the OOM killer, they aren't counted
+	// in Crash.
+	OOM int `json:"oom,omitempty"`
+}
+
+// Summarize computes the summary of a run from its test results.
+func Summarize(tcs []*TestCase) Summary {
+	var s Summary
+	for _, tc := range tcs {
+		switch {
+		case tc.OOM:
+			s.OOM++
+		case tc.Crash:
+			s.Crash++
+		case tc.Pass:
+			s.Pass++
+		default:
+			s.Fail++
+		}
+	}
+	return s
+}
+
+// RawCase is a test result kept as read, so the merge preserves the fields
+// unknown to TestCase.
+type RawCase struct {
+	TestCase
+	raw json.RawMessage
+}
+
+func (c *RawCase) UnmarshalJSON(b []byte) error {
+	c.raw = append(c.raw[:0], b...)
+	return json.Unmarshal(b, &c.TestCase)
+}
+
+func (c *RawCase) MarshalJSON() ([]byte, error) {
+	return c.raw, nil
+}
+
+// testCases returns the decoded test results.
+func testCases(rcs []*RawCase) []*TestCase {
+	tcs := make([]*TestCase, 0, len(rcs))
+	for _, rc := range rcs {
+		tcs = append(tcs, &rc.TestCase)
+	}
+	return tcs
+}
+
+// Merge combines several runs into one, deduplicating the tests by name.
+// When a test appears more than once, a non crash result is preferred over a
+// crash one, otherwise the first result read is kept.
+// The merged results are sorted by name.
+func Merge(runs ...[]*RawCase) []*RawCase {
+	m := make(map[string]*RawCase)
+	for _, tcs := range runs {
+		for _, tc := range tcs {
+			prev, ok := m[tc.Name]
+			if !ok || (prev.Crash && !tc.Crash) {
+				m[tc.Name] = tc
+			}
+		}
+	}
+
+	merged := make([]*RawCase, 0, len(m))
+	for _, tc := range m {
+		merged = append(merged, tc)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Name < merged[j].Name
+	})
+
+	return merged
+}
+
+// readRaw reads the test results of a file, keeping their raw JSON.
+func readRaw(name string) ([]*RawCase, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("open file %s: %w", name, err)
+	}
+	defer f.Close()
+
+	return read[RawCase](f)
+}
+
+// runMerge implements the merge sub command.
+func runMerge(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+	flags.SetOutput(stderr)
+
+	var (
+		out     = flags.String("o", "", "output file, default to stdout")
+		summary = flags.Bool("summary", false, "display the merged summary on stderr")
+	)
+
+	bin := args[0]
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: %s merge [-o <output>] <run.json>...\n", bin)
+		fmt.Fprintf(stderr, "Merge sharded WPT test results into one file\n")
+		fmt.Fprintf(stderr, "\nCommand line options:\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	files := flags.Args()
+	if len(files) == 0 {
+		flags.Usage()
+		return fmt.Errorf("bad arguments")
+	}
+
+	runs := make([][]*RawCase, 0, len(files))
+	for _, name := range files {
+		tcs, err := readRaw(name)
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+		runs = append(runs, tcs)
+	}
+
+	merged := Merge(runs...)
+
+	w := stdout
+	var f *os.File
+	if *out != "" {
+		var err error
+		f, err = os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("create %s: %w", *out, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := json.NewEncoder(w).Encode(merged); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if f != nil {
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("write %s: %w", *out, err)
+		}
+	}
+
+	if *summary {
+		s := Summarize(testCases(merged))
+		fmt.Fprintf(stderr, "P %s\tF %s\tC %s\tO %s\n", intf(s.Pass), intf(s.Fail), intf(s.Crash), intf(s.OOM))
+	}
+
+	return nil
+}
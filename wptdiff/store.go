@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Source provides the history of the runs and their results.
+type Source interface {
+	FetchHistory(ctx context.Context) ([]Run, error)
+	Fetch(ctx context.Context, date time.Time, commit Commit) ([]*TestCase, error)
+}
+
+// NewSource returns the source from its location: an http base URL or a
+// local store directory.
+func NewSource(location string) Source {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return NewClient(strings.TrimSuffix(location, "/"))
+	}
+	return &Store{Dir: location}
+}
+
+// Store is a local directory of runs, organized like the remote one: an
+// history.json index and one results file per run.
+type Store struct {
+	Dir string
+}
+
+const (
+	storeIndex      = "history.json"
+	storeDateFormat = "2006-01-02_15-04"
+)
+
+// file returns the results file of a run.
+func (s *Store) file(date time.Time, commit Commit) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("%s_%s.json", date.UTC().Format(storeDateFormat), string(commit)))
+}
+
+func (s *Store) FetchHistory(ctx context.Context) ([]Run, error) {
+	f, err := os.Open(filepath.Join(s.Dir, storeIndex))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open index: %w", err)
+	}
+	defer f.Close()
+
+	var runs []Run
+	if err := json.NewDecoder(f).Decode(&runs); err != nil {
+		return nil, fmt.Errorf("decode index: %w", err)
+	}
+
+	return runs, nil
+}
+
+func (s *Store) Fetch(ctx context.Context, date time.Time, commit Commit) ([]*TestCase, error) {
+	if commit.IsLocal() {
+		return fetchLocal(ctx, string(commit))
+	}
+	return fetchLocal(ctx, s.file(date, commit))
+}
+
+// Import adds the results of a run to the store, as read. The run's summary
+// is computed from the results. An existing run with the same commit and
+// date is replaced.
+func (s *Store) Import(ctx context.Context, commit Commit, date time.Time, tcs []*RawCase) (Run, error) {
+	run := Run{
+		Commit:  commit,
+		Date:    date.UTC().Truncate(time.Minute),
+		Summary: Summarize(testCases(tcs)),
+	}
+
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return run, fmt.Errorf("create store: %w", err)
+	}
+
+	if err := writeJSON(s.file(run.Date, run.Commit), tcs); err != nil {
+		return run, fmt.Errorf("write results: %w", err)
+	}
+
+	runs, err := s.FetchHistory(ctx)
+	if err != nil {
+		return run, err
+	}
+
+	runs = append(runs, run)
+	// keep the last imported on duplicates.
+	for i := len(runs) - 2; i >= 0; i-- {
+		if runs[i].Commit == run.Commit && runs[i].Date.Equal(run.Date) {
+			runs = append(runs[:i], runs[i+1:]...)
+		}
+	}
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].Date.Before(runs[j].Date)
+	})
+
+	if err := writeJSON(filepath.Join(s.Dir, storeIndex), runs); err != nil {
+		return run, fmt.Errorf("write index: %w", err)
+	}
+
+	return run, nil
+}
+
+// writeJSON writes v into the file, replacing it atomically.
+func writeJSON(name string, v any) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(v); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+// runImport implements the import sub command.
+func runImport(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+	flags.SetOutput(stderr)
+
+	var (
+		dir    = flags.String("source", "", "local store directory")
+		commit = flags.String("commit", "", "commit of the run")
+		date   = flags.String("date", "", "date of the run, RFC3339 or 2006-01-02 15:04 in UTC, default to now")
+	)
+
+	bin := args[0]
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: %s import -source <dir> -commit <commit> [-date <date>] <run.json>\n", bin)
+		fmt.Fprintf(stderr, "Import WPT test results into a local store\n")
+		fmt.Fprintf(stderr, "\nCommand line options:\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 || *dir == "" || *commit == "" {
+		flags.Usage()
+		return fmt.Errorf("bad arguments")
+	}
+
+	if strings.HasPrefix(*dir, "http://") || strings.HasPrefix(*dir, "https://") {
+		return fmt.Errorf("import requires a local store directory")
+	}
+
+	t := time.Now()
+	if *date != "" {
+		var err error
+		if t, err = parseDate(*date); err != nil {
+			return err
+		}
+	}
+
+	tcs, err := readRaw(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	store := &Store{Dir: *dir}
+	run, err := store.Import(ctx, Commit(*commit), t, tcs)
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+
+	fmt.Fprintf(stdout, "%s\tP %s\tF %s\tC %s\tO %s\t%v\n",
+		run.Date.Format("2006-01-02 15:04"),
+		intf(run.Summary.Pass), intf(run.Summary.Fail), intf(run.Summary.Crash), intf(run.Summary.OOM),
+		run.Commit,
+	)
+
+	return nil
+}
+
+// parseDate parses a RFC3339 date or a UTC date formatted as 2006-01-02 15:04.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q", s)
+	}
+	return t, nil
+}
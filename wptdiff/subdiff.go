@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Sub case changes.
+const (
+	ChangePass    = "pass"
+	ChangeFail    = "fail"
+	ChangeStatus  = "status"
+	ChangeMessage = "message"
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeRenamed = "renamed"
+)
+
+// SubDiff is the change of a sub case between two runs.
+type SubDiff struct {
+	Name string
+	// Change is one of pass, fail, status, message, added, removed or
+	// renamed.
+	Change string
+	Prev   *TestCase
+	Last   *TestCase
+}
+
+// occurrence identifies a sub case by its name and its rank among the sub
+// cases of the same name.
+type occurrence struct {
+	name string
+	n    int
+}
+
+func occurrences(subs []*TestCase) []occurrence {
+	count := make(map[string]int, len(subs))
+	occs := make([]occurrence, len(subs))
+	for i, s := range subs {
+		occs[i] = occurrence{name: s.Name, n: count[s.Name]}
+		count[s.Name]++
+	}
+	return occs
+}
+
+// matchSubCases pairs the sub cases of the two runs by name. Duplicated names
+// are paired in their order of appearance. A missing sub case is nil in the
+// pair.
+// The unpaired sub cases placed between the same paired ones are considered
+// renamed when there are as many in both runs, they are paired in order.
+// The pairs follow the order of prev, the added sub cases come last.
+func matchSubCases(last, prev []*TestCase) [][2]*TestCase {
+	lindex := make(map[occurrence]int, len(last))
+	for i, o := range occurrences(last) {
+		lindex[o] = i
+	}
+
+	// plast is the index of the last sub case paired with the prev one.
+	plast := make([]int, len(prev))
+	// lprev is the index of the prev sub case paired with the last one.
+	lprev := make([]int, len(last))
+	for i := range lprev {
+		lprev[i] = -1
+	}
+	for i, o := range occurrences(prev) {
+		j, ok := lindex[o]
+		if !ok {
+			plast[i] = -1
+			continue
+		}
+		plast[i] = j
+		lprev[j] = i
+	}
+
+	// gaps groups the unpaired sub cases by the index of the previous paired
+	// prev sub case.
+	type gap struct {
+		prev, last []int
+	}
+	gaps := make(map[int]*gap)
+	at := func(anchor int) *gap {
+		g, ok := gaps[anchor]
+		if !ok {
+			g = &gap{}
+			gaps[anchor] = g
+		}
+		return g
+	}
+	anchor := -1
+	for i, j := range plast {
+		if j >= 0 {
+			anchor = i
+			continue
+		}
+		g := at(anchor)
+		g.prev = append(g.prev, i)
+	}
+	anchor = -1
+	for j, i := range lprev {
+		if i >= 0 {
+			anchor = i
+			continue
+		}
+		g := at(anchor)
+		g.last = append(g.last, j)
+	}
+	for _, g := range gaps {
+		if len(g.prev) != len(g.last) {
+			continue
+		}
+		for k, i := range g.prev {
+			plast[i] = g.last[k]
+			lprev[g.last[k]] = i
+		}
+	}
+
+	pairs := make([][2]*TestCase, 0, len(prev))
+	for i, p := range prev {
+		var l *TestCase
+		if j := plast[i]; j >= 0 {
+			l = last[j]
+		}
+		pairs = append(pairs, [2]*TestCase{l, p})
+	}
+	for j, l := range last {
+		if lprev[j] < 0 {
+			pairs = append(pairs, [2]*TestCase{l, nil})
+		}
+	}
+
+	return pairs
+}
+
+// DiffSubCases returns the changes of the sub cases of a test.
+func DiffSubCases(last, prev *TestCase) []SubDiff {
+	var lsubs, psubs []*TestCase
+	if last != nil {
+		lsubs = last.SubCases
+	}
+	if prev != nil {
+		psubs = prev.SubCases
+	}
+
+	var diffs []SubDiff
+	for _, pair := range matchSubCases(lsubs, psubs) {
+		l, p := pair[0], pair[1]
+
+		var change string
+		switch {
+		case p == nil:
+			change = ChangeAdded
+		case l == nil:
+			change = ChangeRemoved
+		case l.Name != p.Name:
+			change = ChangeRenamed
+		case l.Pass && !p.Pass:
+			change = ChangePass
+		case !l.Pass && p.Pass:
+			change = ChangeFail
+		case l.Status != "" && p.Status != "" && l.Status != p.Status:
+			change = ChangeStatus
+		case l.Message != p.Message:
+			change = ChangeMessage
+		default:
+			continue
+		}
+
+		name := ""
+		if l != nil {
+			name = l.Name
+		} else {
+			name = p.Name
+		}
+		diffs = append(diffs, SubDiff{Name: name, Change: change, Prev: p, Last: l})
+	}
+
+	return diffs
+}
+
+// subSymbol returns the text symbol of a change.
+func subSymbol(change string) string {
+	switch change {
+	case ChangePass:
+		return "P"
+	case ChangeFail:
+		return "F"
+	case ChangeStatus:
+		return "S"
+	case ChangeMessage:
+		return "M"
+	case ChangeAdded:
+		return "+"
+	case ChangeRemoved:
+		return "-"
+	case ChangeRenamed:
+		return "R"
+	}
+	return "?"
+}
+
+// writeSubDiffs writes the sub cases changes in text.
+func writeSubDiffs(w io.Writer, diffs []SubDiff) {
+	for _, d := range diffs {
+		switch d.Change {
+		case ChangeAdded:
+			fmt.Fprintf(w, "\t%s %s\t%q\t%s\n", subSymbol(d.Change), tcf(d.Last), d.Name, d.Last.Message)
+		case ChangeRemoved:
+			fmt.Fprintf(w, "\t%s %s\t%q\n", subSymbol(d.Change), tcf(d.Prev), d.Name)
+		case ChangeRenamed:
+			fmt.Fprintf(w, "\t%s %s>%s\t%q -> %q\t%s\n", subSymbol(d.Change), tcf(d.Prev), tcf(d.Last), d.Prev.Name, d.Name, d.Last.Message)
+		case ChangeMessage:
+			fmt.Fprintf(w, "\t%s %s\t%q\n\t\t- %s\n\t\t+ %s\n", subSymbol(d.Change), tcf(d.Last), d.Name, d.Prev.Message, d.Last.Message)
+		default:
+			fmt.Fprintf(w, "\t%s %s>%s\t%q\t%s\n", subSymbol(d.Change), tcf(d.Prev), tcf(d.Last), d.Name, d.Last.Message)
+		}
+	}
+}
+
+// jsonReport is the JSON output of a comparison.
+type jsonReport struct {
+	Prev  Run        `json:"prev"`
+	Last  Run        `json:"last"`
+	Tests []jsonDiff `json:"tests"`
+}
+
+// jsonDiff is the JSON output of a test diff, without the full results.
+type jsonDiff struct {
+	Name       string        `json:"name"`
+	Regression bool          `json:"regression"`
+	Prev       string        `json:"prev"`
+	Last       string        `json:"last"`
+	PrevCases  string        `json:"prev_cases,omitempty"`
+	LastCases  string        `json:"last_cases,omitempty"`
+	Cases      []jsonSubDiff `json:"cases"`
+}
+
+// jsonSubDiff is the JSON output of a sub case change.
+type jsonSubDiff struct {
+	Name        string `json:"name"`
+	PrevName    string `json:"prev_name,omitempty"`
+	Change      string `json:"change"`
+	Prev        string `json:"prev"`
+	Last        string `json:"last"`
+	PrevMessage string `json:"prev_message,omitempty"`
+	LastMessage string `json:"last_message,omitempty"`
+}
+
+// writeJSONDiffs writes the diffs with their sub cases changes in JSON.
+func writeJSONDiffs(w io.Writer, prev, last Run, diffs []Diff) error {
+	report := jsonReport{Prev: prev, Last: last, Tests: make([]jsonDiff, 0, len(diffs))}
+	for _, d := range diffs {
+		jd := jsonDiff{
+			Name:       d.Name,
+			Regression: d.Regression,
+			Prev:       tcf(d.Prev),
+			Last:       tcf(d.Last),
+			Cases:      make([]jsonSubDiff, 0, len(d.Cases)),
+		}
+		if d.Prev != nil {
+			jd.PrevCases = sub(d.Prev)
+		}
+		if d.Last != nil {
+			jd.LastCases = sub(d.Last)
+		}
+		for _, c := range d.Cases {
+			jc := jsonSubDiff{Name: c.Name, Change: c.Change, Prev: tcf(c.Prev), Last: tcf(c.Last)}
+			if c.Change == ChangeRenamed {
+				jc.PrevName = c.Prev.Name
+			}
+			if c.Prev != nil {
+				jc.PrevMessage = c.Prev.Message
+			}
+			if c.Last != nil {
+				jc.LastMessage = c.Last.Message
+			}
+			jd.Cases = append(jd.Cases, jc)
+		}
+		report.Tests = append(report.Tests, jd)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Trend is the history of a test or a directory over several runs.
+type Trend struct {
+	Name string
+	// Outcomes are the outcomes per run, as displayed by tcf, empty when the
+	// test is missing from the run. A directory is P when all its tests pass.
+	Outcomes []string
+	// Pass is the number of passing sub cases per run.
+	Pass []int
+}
+
+// passing returns the pass state of the run i and if the test is present.
+func (t *Trend) passing(i int) (bool, bool) {
+	o := t.Outcomes[i]
+	return o == "P", o != ""
+}
+
+// Flips returns the number of times the test switched between passing and
+// failing. The runs missing the test are ignored.
+func (t *Trend) Flips() int {
+	var (
+		flips int
+		prev  bool
+		seen  bool
+	)
+	for i := range t.Outcomes {
+		pass, ok := t.passing(i)
+		if !ok {
+			continue
+		}
+		if seen && pass != prev {
+			flips++
+		}
+		prev, seen = pass, true
+	}
+	return flips
+}
+
+// Score returns the flakiness score: the ratio of flips over the possible
+// flips, from 0 for stable to 1 for a flip at every run.
+func (t *Trend) Score() float64 {
+	var present int
+	for i := range t.Outcomes {
+		if _, ok := t.passing(i); ok {
+			present++
+		}
+	}
+	if present < 2 {
+		return 0
+	}
+	return float64(t.Flips()) / float64(present-1)
+}
+
+// Since returns the index of the run from which the test has its last pass
+// state, -1 if the test is missing from all the runs.
+func (t *Trend) Since() int {
+	since := -1
+	var prev bool
+	for i := range t.Outcomes {
+		pass, ok := t.passing(i)
+		if !ok {
+			continue
+		}
+		if since < 0 || pass != prev {
+			since = i
+		}
+		prev = pass
+	}
+	return since
+}
+
+// Last returns the last known outcome.
+func (t *Trend) Last() string {
+	for i := len(t.Outcomes) - 1; i >= 0; i-- {
+		if o := t.Outcomes[i]; o != "" {
+			return o
+		}
+	}
+	return tcf(nil)
+}
+
+// ListTrends returns the trends of the tests, or of their directories, over
+// the runs, sorted by name.
+func ListTrends(runs [][]*TestCase, dir bool) []*Trend {
+	m := make(map[string]*Trend)
+	get := func(name string) *Trend {
+		t, ok := m[name]
+		if !ok {
+			t = &Trend{
+				Name:     name,
+				Outcomes: make([]string, len(runs)),
+				Pass:     make([]int, len(runs)),
+			}
+			m[name] = t
+		}
+		return t
+	}
+
+	for i, tcs := range runs {
+		for _, tc := range tcs {
+			if !dir {
+				t := get(tc.Name)
+				t.Outcomes[i] = tcf(tc)
+				t.Pass[i] = countPass(tc)
+				continue
+			}
+
+			t := get(path.Dir(tc.Name))
+			switch {
+			case t.Outcomes[i] == "" && tc.Pass:
+				t.Outcomes[i] = "P"
+			case !tc.Pass:
+				t.Outcomes[i] = "F"
+			}
+			t.Pass[i] += countPass(tc)
+		}
+	}
+
+	trends := make([]*Trend, 0, len(m))
+	for _, t := range m {
+		trends = append(trends, t)
+	}
+	sort.Slice(trends, func(i, j int) bool {
+		return trends[i].Name < trends[j].Name
+	})
+
+	return trends
+}
+
+// Changes returns the sum of the pass count changes between the runs. The
+// runs missing the test are ignored.
+func (t *Trend) Changes() int {
+	var (
+		changes int
+		prev    int
+		seen    bool
+	)
+	for i, pass := range t.Pass {
+		if t.Outcomes[i] == "" {
+			continue
+		}
+		if seen {
+			changes += max(pass-prev, prev-pass)
+		}
+		prev, seen = pass, true
+	}
+	return changes
+}
+
+// topTrends returns the n trends with the most pass count changes, in their
+// original order. It returns all the trends if n is 0.
+func topTrends(trends []*Trend, n int) []*Trend {
+	if n <= 0 || n >= len(trends) {
+		return trends
+	}
+
+	rank := make([]int, len(trends))
+	for i := range rank {
+		rank[i] = i
+	}
+	sort.SliceStable(rank, func(i, j int) bool {
+		return trends[rank[i]].Changes() > trends[rank[j]].Changes()
+	})
+	rank = rank[:n]
+	sort.Ints(rank)
+
+	top := make([]*Trend, 0, n)
+	for _, i := range rank {
+		top = append(top, trends[i])
+	}
+	return top
+}
+
+// countPass returns the number of passing sub cases, or 1 for a passing test
+// without sub cases.
+func countPass(tc *TestCase) int {
+	if len(tc.SubCases) == 0 {
+		if tc.Pass {
+			return 1
+		}
+		return 0
+	}
+
+	n := 0
+	for _, s := range tc.SubCases {
+		if s.Pass {
+			n++
+		}
+	}
+	return n
+}
+
+// writeTrendCSV writes the pass count time series, one row per run and one
+// column per trend.
+func writeTrendCSV(w io.Writer, runs []Run, trends []*Trend) error {
+	cw := csv.NewWriter(w)
+
+	header := []string{"date", "commit"}
+	for _, t := range trends {
+		header = append(header, t.Name)
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for i, run := range runs {
+		row := []string{run.Date.Format("2006-01-02 15:04"), string(run.Commit)}
+		for _, t := range trends {
+			if t.Outcomes[i] == "" {
+				// missing from the run.
+				row = append(row, "")
+				continue
+			}
+			row = append(row, strconv.Itoa(t.Pass[i]))
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// runTrend implements the trend sub command.
+func runTrend(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+	flags.SetOutput(stderr)
+
+	var (
+		source = flags.String("source", perfURL, "runs source: http base URL or local store directory")
+		n      = flags.Int("n", 10, "number of runs to analyze, 0 for all")
+		dir    = flags.Bool("dir", false, "group the tests per directory")
+		prefix = flags.String("filter", "", "analyze only the tests or directories starting with the prefix")
+		all    = flags.Bool("all", false, "display the stable tests too")
+		csvOut = flags.String("csv", "", "write the pass count time series in a CSV file, - for stdout")
+		pngOut = flags.String("png", "", "write the pass count time series chart in a PNG file")
+		top    = flags.Int("top", len(colors), "number of trends with the most pass count changes to draw in the chart, 0 for all")
+	)
+
+	bin := args[0]
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: %s trend [-n <runs>] [-dir] [-filter <prefix>] [-csv <file>] [-png <file>] [-top <n>]\n", bin)
+		fmt.Fprintf(stderr, "Analyze WPT test results over many runs\n")
+		fmt.Fprintf(stderr, "\nCommand line options:\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return fmt.Errorf("bad arguments")
+	}
+
+	cli := NewSource(*source)
+
+	runs, err := cli.FetchHistory(ctx)
+	if err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	if *n > 0 && *n < len(runs) {
+		runs = runs[len(runs)-*n:]
+	}
+	if len(runs) < 2 {
+		return fmt.Errorf("not enough runs to analyze: %d", len(runs))
+	}
+
+	results := make([][]*TestCase, 0, len(runs))
+	for _, run := range runs {
+		slog.Debug("fetch", slog.Any("commit", run.Commit), slog.Time("date", run.Date))
+		tcs, err := cli.Fetch(ctx, run.Date, run.Commit)
+		if err != nil {
+			return fmt.Errorf("fetch %v: %w", run.Commit, err)
+		}
+		results = append(results, tcs)
+	}
+
+	var trends []*Trend
+	for _, t := range ListTrends(results, *dir) {
+		if !strings.HasPrefix(t.Name, *prefix) {
+			continue
+		}
+		if !*all && t.Flips() == 0 {
+			continue
+		}
+		trends = append(trends, t)
+	}
+
+	if *csvOut == "-" {
+		if err := writeTrendCSV(stdout, runs, trends); err != nil {
+			return fmt.Errorf("write csv: %w", err)
+		}
+	} else {
+		writeTrends(stdout, runs, trends)
+	}
+
+	if *csvOut != "" && *csvOut != "-" {
+		f, err := os.Create(*csvOut)
+		if err != nil {
+			return fmt.Errorf("create csv: %w", err)
+		}
+		defer f.Close()
+
+		if err := writeTrendCSV(f, runs, trends); err != nil {
+			return fmt.Errorf("write csv: %w", err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("write csv: %w", err)
+		}
+	}
+
+	if *pngOut != "" {
+		if err := saveTrendChart(*pngOut, topTrends(trends, *top)); err != nil {
+			return fmt.Errorf("chart: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// writeTrends writes the trends in text, the most flaky first.
+func writeTrends(stdout io.Writer, runs []Run, trends []*Trend) {
+	fmt.Fprintf(stdout, "From %v\t%s\n", runs[0].Commit, runs[0].Date.Format("2006-01-02 15:04"))
+	fmt.Fprintf(stdout, "To   %v\t%s\n", runs[len(runs)-1].Commit, runs[len(runs)-1].Date.Format("2006-01-02 15:04"))
+	fmt.Fprintf(stdout, "\n")
+
+	// The most flaky first.
+	sorted := append([]*Trend(nil), trends...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Flips() > sorted[j].Flips()
+	})
+
+	fmt.Fprintf(stdout, "  %5s %5s\t%-16s %-8s\t%s\n", "Flips", "Score", "Since", "Commit", "Name")
+	for _, t := range sorted {
+		since := "-"
+		var commit Commit
+		if i := t.Since(); i >= 0 {
+			since = runs[i].Date.Format("2006-01-02 15:04")
+			commit = runs[i].Commit
+		}
+		fmt.Fprintf(stdout, "%s %5d %5.2f\t%-16s %-8v\t%s\n",
+			t.Last(), t.Flips(), t.Score(), since, commit, t.Name,
+		)
+	}
+}
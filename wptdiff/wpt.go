@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -43,11 +45,7 @@ func (c Commit) IsLocal() bool {
 type Run struct {
 	Commit  Commit    `json:"commit"`
 	Date    time.Time `json:"datetime"`
-	Summary struct {
-		Pass  int `json:"pass"`
-		Fail  int `json:"fail"`
-		Crash int `json:"crash"`
-	} `json:"data"`
+	Summary Summary   `json:"data"`
 }
 
 func (c *Client) FetchHistory(ctx context.Context) ([]Run, error) {
@@ -89,6 +87,15 @@ type TestCase struct {
 	Crash    bool        `json:"crash"`
 	SubCases []*TestCase `json:"cases"`
 	Elapsed  int         `json:"elapsed"`
+
+	// OOM is set when the browser running the test was killed by the OOM
+	// killer, Crash is set too.
+	OOM bool `json:"oom,omitempty"`
+
+	// Status is the testharness status of a sub case: Pass, Fail, Timeout,
+	// Not Run or Optional Feature Unsupported. It's empty for the tests and
+	// for the runs recorded before its introduction.
+	Status string `json:"status,omitempty"`
 }
 
 func (c *Client) Fetch(ctx context.Context, date time.Time, commit Commit) ([]*TestCase, error) {
@@ -116,7 +123,7 @@ func (c *Client) Fetch(ctx context.Context, date time.Time, commit Commit) ([]*T
 		return nil, fmt.Errorf("bad status: %d", resp.StatusCode)
 	}
 
-	return read(resp.Body)
+	return read[TestCase](resp.Body)
 }
 
 func fetchLocal(ctx context.Context, name string) ([]*TestCase, error) {
@@ -126,14 +133,55 @@ func fetchLocal(ctx context.Context, name string) ([]*TestCase, error) {
 	}
 	defer f.Close()
 
-	return read(f)
+	return read[TestCase](f)
 }
 
-func read(r io.Reader) ([]*TestCase, error) {
-	var tcs []*TestCase
-	dec := json.NewDecoder(r)
-	if err := dec.Decode(&tcs); err != nil {
-		return nil, fmt.Errorf("decode: %w", err)
+// read decodes the test results, either a JSON array or one JSON test result
+// per line (NDJSON).
+func read[T any](r io.Reader) ([]*T, error) {
+	br := bufio.NewReader(r)
+
+	// Look at the first non space char to detect the format.
+	var first byte
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read: %w", err)
+		}
+		if b != ' ' && b != '\t' && b != '\n' && b != '\r' {
+			first = b
+			br.UnreadByte()
+			break
+		}
+	}
+
+	var tcs []*T
+	dec := json.NewDecoder(br)
+
+	if first == '[' {
+		if err := dec.Decode(&tcs); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+		return tcs, nil
+	}
+
+	for {
+		var tc T
+		err := dec.Decode(&tc)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// The last line of an interrupted run can be truncated.
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+		tcs = append(tcs, &tc)
 	}
 
 	return tcs, nil
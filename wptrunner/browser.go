@@ -2,20 +2,109 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
-	"math/rand"
+	"net/http"
+	"os"
 	"os/exec"
+	"slices"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"golang.org/x/sync/errgroup"
 )
 
 type Browser interface {
 	Start(context.Context) error
 	Stop()
-	Ready() <-chan string
+	// Ready returns a lease of a ready browser to run the test. The channel
+	// is closed without lease if the context is done first.
+	Ready(ctx context.Context, test string) <-chan *Lease
+	// Restarts returns the number of browser restarts since the start.
+	Restarts() int
+}
+
+// Lease is a test running on a browser. Done must be called once the test is
+// over.
+type Lease struct {
+	CDP string
+
+	// id identifies the lease in the process, the same test can run
+	// several times concurrently with --repeat.
+	id   int
+	b    *ProcessBrowser
+	proc *process
+}
+
+// Done releases the lease.
+func (l *Lease) Done() {
+	if l.proc == nil {
+		return
+	}
+
+	l.b.Lock()
+	delete(l.proc.inflight, l.id)
+	l.b.Unlock()
+
+	l.b.changed()
+}
+
+// Exit waits at most d for the browser process running the test to exit.
+// It returns the exit details or nil if the process is still running.
+func (l *Lease) Exit(d time.Duration) *Exit {
+	if l.proc == nil {
+		return nil
+	}
+
+	select {
+	case <-l.proc.done:
+		return l.proc.exit
+	default:
+	}
+
+	select {
+	case <-l.proc.done:
+		return l.proc.exit
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// Profile starts to sample the resources usage of the browser. It returns
+// nil if the browser process isn't managed by the runner.
+func (l *Lease) Profile() (stop func() (rss0, maxrss uint64, cpu time.Duration)) {
+	if l.proc == nil {
+		return nil
+	}
+
+	return profile(l.proc.cmd)
+}
+
+// Exit describes the end of a browser process.
+type Exit struct {
+	Status string   `json:"status"`
+	Signal string   `json:"signal,omitempty"`
+	Stderr string   `json:"stderr,omitempty"`
+	Tests  []string `json:"tests"`
+	// OOM is set when the browser was killed by the OOM killer of its
+	// cgroup.
+	OOM bool `json:"oom,omitempty"`
+}
+
+func (e *Exit) String() string {
+	if e.OOM {
+		return fmt.Sprintf("browser oom killed (%s)", e.Status)
+	}
+	if e.Signal != "" {
+		return fmt.Sprintf("browser %s (%s)", e.Status, e.Signal)
+	}
+	return "browser " + e.Status
 }
 
 type NoopBrowser struct {
@@ -26,12 +115,38 @@ func (b NoopBrowser) Start(_ context.Context) error {
 	return nil
 }
 func (b NoopBrowser) Stop() {}
-func (b NoopBrowser) Ready() <-chan string {
-	ch := make(chan string, 1)
-	ch <- b.CDP
+func (b NoopBrowser) Restarts() int {
+	return 0
+}
+func (b NoopBrowser) Ready(ctx context.Context, _ string) <-chan *Lease {
+	ch := make(chan *Lease, 1)
+	if ctx.Err() == nil {
+		ch <- &Lease{CDP: b.CDP}
+	}
+	close(ch)
 	return ch
 }
 
+// stderrTail is the max size of the browser's stderr kept on exit.
+const stderrTail = 2048
+
+// process is a single execution of the browser.
+type process struct {
+	cmd    *exec.Cmd
+	stderr *tailWriter
+
+	// tests running on the process by lease id, protected by the
+	// ProcessBrowser lock.
+	inflight map[int]string
+
+	// exit is set before done is closed.
+	exit *Exit
+	done chan struct{}
+
+	// ooms is the cgroup OOM kills count before the process start.
+	ooms int
+}
+
 type ProcessBrowser struct {
 	sync.Mutex
 
@@ -39,18 +154,48 @@ type ProcessBrowser struct {
 	Port     int
 	Memlimit uint
 
+	// OnChange is called when the browser becomes ready or when a test is
+	// done.
+	OnChange func()
+
+	// Cgroup limits the resources of the browser process, if set.
+	Cgroup *Cgroup
+
 	ready   chan struct{}
 	running bool
 	done    chan struct{}
 	cancel  context.CancelFunc
+	proc    *process
+	// leases is the last lease id.
+	leases int
+
+	restarts atomic.Int64
+}
+
+func (b *ProcessBrowser) Restarts() int {
+	return int(b.restarts.Load())
 }
 
 func (b *ProcessBrowser) Stop() {
+	// Don't keep the lock while waiting, the process goroutine needs it to
+	// terminate.
 	b.Lock()
-	defer b.Unlock()
+	cancel, done := b.cancel, b.done
+	b.Unlock()
 
-	b.cancel()
-	<-b.done
+	if cancel == nil {
+		// never started
+		return
+	}
+
+	cancel()
+	<-done
+
+	if b.Cgroup != nil {
+		if err := b.Cgroup.Remove(); err != nil {
+			slog.Debug("browser cgroup", slog.Int("port", b.Port), slog.Any("err", err))
+		}
+	}
 }
 
 var ErrBrowserIsRunning = errors.New("browser is running")
@@ -59,15 +204,87 @@ func (b *ProcessBrowser) CDP() string {
 	return fmt.Sprintf("ws://127.0.0.1:%d", b.Port)
 }
 
-// non blocking
+const (
+	// StartTimeout is the max duration for a started browser to answer CDP
+	// requests.
+	StartTimeout = 10 * time.Second
+
+	// readyInterval is the delay between two readiness probes.
+	readyInterval = 50 * time.Millisecond
+
+	// Bounds of the delay before restarting a browser failing to start.
+	restartBackoffMin = 500 * time.Millisecond
+	restartBackoffMax = 30 * time.Second
+)
+
+// Start starts the browser and blocks until it's ready.
+// The browser is restarted on exit until the context is done.
 func (b *ProcessBrowser) Start(ctx context.Context) error {
 	b.Lock()
-	defer b.Unlock()
-
 	if b.running {
+		b.Unlock()
 		return ErrBrowserIsRunning
 	}
+	b.running = true
+	b.Unlock()
+
+	if b.Cgroup != nil {
+		if err := b.Cgroup.Create(); err != nil {
+			b.Lock()
+			b.running = false
+			b.Unlock()
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	// Don't keep the lock while starting, the process goroutine needs it on
+	// exit.
+	proc, err := b.launch(ctx)
+	if err == nil {
+		if err = b.waitReady(ctx, proc); err != nil {
+			<-proc.done
+		}
+	}
+	if err != nil {
+		cancel()
+
+		b.Lock()
+		b.running = false
+		b.Unlock()
+		return err
+	}
+
+	done := make(chan struct{})
+
+	b.Lock()
+	b.cancel = cancel
+	b.ready = make(chan struct{})
+	if proc.exit == nil {
+		// Else the process already exited and supervise restarts it.
+		close(b.ready)
+	}
+	b.done = done
+	b.proc = proc
+	b.Unlock()
+
+	go func() {
+		defer close(done)
+		defer cancel()
+
+		b.supervise(ctx, proc)
+
+		b.Lock()
+		b.running = false
+		b.Unlock()
+	}()
 
+	return nil
+}
+
+// launch starts a new browser process.
+func (b *ProcessBrowser) launch(ctx context.Context) (*process, error) {
 	args := []string{
 		"serve",
 		"--log-level", "error",
@@ -81,93 +298,392 @@ func (b *ProcessBrowser) Start(ctx context.Context) error {
 	}
 
 	cmd := exec.CommandContext(ctx, b.Path, args...)
+	proc := &process{
+		cmd:      cmd,
+		stderr:   &tailWriter{max: stderrTail},
+		inflight: make(map[int]string),
+		done:     make(chan struct{}),
+	}
+	cmd.Stderr = proc.stderr
 
-	// We keep a reference to the original context to restart the browser with
-	// it.
-	restartctx := ctx
-	ctx, cancel := context.WithCancel(ctx)
-	b.cancel = cancel
+	if b.Cgroup != nil {
+		n, err := b.Cgroup.OOMKills()
+		if err != nil {
+			return nil, err
+		}
+		proc.ooms = n
+
+		release, err := b.Cgroup.attach(cmd)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
 
 	slog.Info("starting browser", slog.String("cmd", cmd.String()))
 	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("start command: %w", err)
+		return nil, fmt.Errorf("start command: %w", err)
 	}
 
-	ready := make(chan struct{})
-	done := make(chan struct{})
-
-	b.ready = ready
-	b.done = done
-
 	go func() {
-		defer close(done)
-		defer cancel()
-
-		// Wait for readyness
-		time.Sleep(time.Second * 1)
-		close(ready)
-
 		// block until the end
 		if err := cmd.Wait(); err != nil {
 			slog.Debug("browser stop", slog.Any("err", err))
 		}
 
-		if ctx.Err() != nil {
-			return
+		var oom bool
+		if b.Cgroup != nil {
+			n, err := b.Cgroup.OOMKills()
+			if err != nil {
+				slog.Debug("browser cgroup", slog.Int("port", b.Port), slog.Any("err", err))
+			}
+			oom = n > proc.ooms
 		}
 
-		// reset state
+		// record the tests in flight when the process exited.
 		b.Lock()
-		b.ready = make(chan struct{})
-		b.running = false
+		proc.exit = newExit(cmd.ProcessState, proc.stderr.String(), proc.inflight)
+		proc.exit.OOM = oom
+		if b.proc == proc {
+			// the browser is not ready anymore.
+			b.ready = make(chan struct{})
+		}
 		b.Unlock()
+		close(proc.done)
+	}()
 
-		// autorestart
-		if err := b.Start(restartctx); err != nil {
-			slog.Error("browser restart", slog.Any("err", err))
+	return proc, nil
+}
+
+// waitReady blocks until the browser answers to CDP requests.
+// On error, the process is killed.
+func (b *ProcessBrowser) waitReady(ctx context.Context, proc *process) error {
+	ctx, cancel := context.WithTimeout(ctx, StartTimeout)
+	defer cancel()
+
+	u := fmt.Sprintf("http://127.0.0.1:%d", b.Port)
+
+	for {
+		_, err := cdpVersion(ctx, u)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-proc.done:
+			return fmt.Errorf("browser exited before ready: %s: %s", proc.exit.Status, proc.exit.Stderr)
+		case <-ctx.Done():
+			proc.cmd.Process.Kill()
+			return fmt.Errorf("browser not ready after %s: %w", StartTimeout, err)
+		case <-time.After(readyInterval):
+			// try again
+		}
+	}
+}
+
+// supervise restarts the browser each time it exits, until the context is
+// done. Consecutive start failures are retried with an exponential backoff.
+func (b *ProcessBrowser) supervise(ctx context.Context, proc *process) {
+	backoff := restartBackoffMin
+
+	for {
+		<-proc.done
+
+		if ctx.Err() != nil {
 			return
 		}
-	}()
 
-	return nil
+		slog.Info("browser exit",
+			slog.Int("port", b.Port),
+			slog.String("status", proc.exit.Status),
+			slog.String("signal", proc.exit.Signal),
+			slog.Int("inflight", len(proc.exit.Tests)),
+		)
+
+		// autorestart
+		b.restarts.Add(1)
+		for {
+			var err error
+			proc, err = b.launch(ctx)
+			if err == nil {
+				err = b.waitReady(ctx, proc)
+				if err != nil {
+					<-proc.done
+				}
+			}
+			if err == nil {
+				break
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			slog.Error("browser restart",
+				slog.Int("port", b.Port),
+				slog.Any("err", err),
+				slog.Duration("retry", backoff),
+			)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, restartBackoffMax)
+		}
+		backoff = restartBackoffMin
+
+		b.Lock()
+		if proc.exit == nil {
+			b.proc = proc
+			select {
+			case <-b.ready:
+				// already closed, the tests waiting will retry.
+			default:
+				close(b.ready)
+			}
+		}
+		b.Unlock()
+
+		b.changed()
+	}
+}
+
+func (b *ProcessBrowser) changed() {
+	if b.OnChange != nil {
+		b.OnChange()
+	}
+}
+
+// load returns the number of tests running on the browser.
+// ok is false if the browser is not ready.
+func (b *ProcessBrowser) load() (n int, ok bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.proc == nil || b.proc.exit != nil {
+		return 0, false
+	}
+
+	select {
+	case <-b.ready:
+	default:
+		// restarting
+		return 0, false
+	}
+
+	return len(b.proc.inflight), true
+}
+
+// acquire returns a lease on the browser if it's ready, nil otherwise.
+func (b *ProcessBrowser) acquire(test string) *Lease {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.proc == nil || b.proc.exit != nil {
+		return nil
+	}
+
+	select {
+	case <-b.ready:
+	default:
+		return nil
+	}
+
+	b.leases++
+	b.proc.inflight[b.leases] = test
+
+	return &Lease{
+		CDP:  b.CDP(),
+		id:   b.leases,
+		b:    b,
+		proc: b.proc,
+	}
+}
+
+// Version is the browser version returned by the CDP endpoint.
+type Version struct {
+	Browser              string `json:"Browser"`
+	Protocol             string `json:"Protocol-Version"`
+	WebSocketDebuggerURL string `json:"webSocketDebuggerUrl"`
+}
+
+// cdpVersion requests /json/version on the CDP http endpoint.
+func cdpVersion(ctx context.Context, addr string) (*Version, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", addr+"/json/version", nil)
+	if err != nil {
+		return nil, fmt.Errorf("new req: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do req: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %d", resp.StatusCode)
+	}
+
+	var v Version
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+
+	return &v, nil
 }
 
-// blocks until done
-func (b *ProcessBrowser) Ready() <-chan string {
+func (b *ProcessBrowser) Ready(ctx context.Context, test string) <-chan *Lease {
 	b.Lock()
 	defer b.Unlock()
 
 	ready := b.ready
 
-	r := make(chan string)
+	r := make(chan *Lease)
 	go func() {
-		<-ready
-		r <- b.CDP()
-		close(r)
+		defer close(r)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ready:
+			}
+
+			if lease := b.acquire(test); lease != nil {
+				sendLease(ctx, r, lease)
+				return
+			}
+
+			// the process exited meanwhile, wait for the restart.
+			b.Lock()
+			ready = b.ready
+			b.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(readyInterval):
+			}
+		}
 	}()
 
 	return r
 }
 
+// sendLease sends the lease to the waiting test. The lease is released if
+// the test stopped waiting.
+func sendLease(ctx context.Context, r chan<- *Lease, lease *Lease) {
+	select {
+	case r <- lease:
+	case <-ctx.Done():
+		lease.Done()
+	}
+}
+
+// newExit builds the exit details of a process.
+func newExit(ps *os.ProcessState, stderr string, inflight map[int]string) *Exit {
+	exit := &Exit{
+		Status: "unknown",
+		Stderr: stderr,
+		Tests:  make([]string, 0, len(inflight)),
+	}
+	for _, t := range inflight {
+		exit.Tests = append(exit.Tests, t)
+	}
+	sort.Strings(exit.Tests)
+	// The repeated runs of a test are listed once.
+	exit.Tests = slices.Compact(exit.Tests)
+
+	if ps == nil {
+		return exit
+	}
+
+	exit.Status = ps.String()
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		exit.Signal = ws.Signal().String()
+	}
+
+	return exit
+}
+
+// tailWriter keeps the last max bytes written.
+type tailWriter struct {
+	sync.Mutex
+	max int
+	buf []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.buf = append(w.buf, p...)
+	if over := len(w.buf) - w.max; over > 0 {
+		w.buf = w.buf[over:]
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) String() string {
+	w.Lock()
+	defer w.Unlock()
+
+	return string(w.buf)
+}
+
+// PoolBrowser dispatches the tests to the least loaded of its browsers.
 type PoolBrowser struct {
+	// MaxLoad is the max number of concurrent tests per browser, 0 for no
+	// limit.
+	MaxLoad uint
+
 	procs  []*ProcessBrowser
 	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// next is the first browser to check, rotating to spread the tests
+	// between equally loaded browsers.
+	next int
+	// wake is closed and replaced each time a browser state changes.
+	wake chan struct{}
 }
 
 func NewPoolBrowser(path string, n, ml uint) *PoolBrowser {
-	procs := make([]*ProcessBrowser, n)
+	b := &PoolBrowser{
+		procs: make([]*ProcessBrowser, n),
+		wake:  make(chan struct{}),
+	}
+
 	port := 9222
 	for i := range n {
-		procs[i] = &ProcessBrowser{
+		b.procs[i] = &ProcessBrowser{
 			Memlimit: ml,
 			Port:     port + int(i),
 			Path:     path,
+			OnChange: b.changed,
 		}
 	}
 
-	return &PoolBrowser{
-		procs: procs,
+	return b
+}
+
+// changed wakes up the tests waiting for a browser.
+func (b *PoolBrowser) changed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+func (b *PoolBrowser) Restarts() int {
+	var n int
+	for _, p := range b.procs {
+		n += p.Restarts()
 	}
+	return n
 }
 
 func (b *PoolBrowser) Stop() {
@@ -177,21 +693,84 @@ func (b *PoolBrowser) Stop() {
 	}
 }
 
-// non blocking
+// Start starts all the browsers and blocks until they are ready.
 func (b *PoolBrowser) Start(ctx context.Context) error {
 	ctx, b.cancel = context.WithCancel(ctx)
+
+	var wg errgroup.Group
 	for i, p := range b.procs {
-		if err := p.Start(ctx); err != nil {
-			b.cancel()
-			return fmt.Errorf("start %d: %w", i, err)
-		}
+		wg.Go(func() error {
+			if err := p.Start(ctx); err != nil {
+				return fmt.Errorf("start %d: %w", i, err)
+			}
+			return nil
+		})
+	}
+
+	if err := wg.Wait(); err != nil {
+		b.Stop()
+		return err
 	}
 
 	return nil
 }
 
-func (b *PoolBrowser) Ready() <-chan string {
-	i := rand.Intn(len(b.procs))
-	bb := b.procs[i]
-	return bb.Ready()
+func (b *PoolBrowser) Ready(ctx context.Context, test string) <-chan *Lease {
+	r := make(chan *Lease)
+	go func() {
+		defer close(r)
+
+		for {
+			b.mu.Lock()
+			lease := b.acquire(test)
+			wake := b.wake
+			b.mu.Unlock()
+
+			if lease != nil {
+				sendLease(ctx, r, lease)
+				return
+			}
+
+			// All the browsers are busy or restarting.
+			select {
+			case <-ctx.Done():
+				return
+			case <-wake:
+			}
+		}
+	}()
+
+	return r
+}
+
+// acquire leases the least loaded ready browser, under MaxLoad.
+// It returns nil if none is available. Must be called with the lock.
+func (b *PoolBrowser) acquire(test string) *Lease {
+	var (
+		best     *ProcessBrowser
+		bestLoad int
+	)
+
+	n := len(b.procs)
+	for i := range n {
+		p := b.procs[(b.next+i)%n]
+
+		load, ok := p.load()
+		if !ok {
+			continue
+		}
+		if b.MaxLoad > 0 && load >= int(b.MaxLoad) {
+			continue
+		}
+		if best == nil || load < bestLoad {
+			best, bestLoad = p, load
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	b.next = (b.next + 1) % n
+	return best.acquire(test)
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cpuPeriod is the cpu.max period in microseconds.
+const cpuPeriod = 100000
+
+// Cgroup is a cgroup v2 limiting the resources of a browser process, only
+// for linux.
+// Its parent must be delegated to the user running the tests, with the
+// memory and cpu controllers available.
+type Cgroup struct {
+	Path string
+	// MemMax is the memory limit in bytes, 0 for no limit.
+	MemMax uint64
+	// CPUMax is the CPU limit in number of CPUs, 0 for no limit.
+	CPUMax float64
+}
+
+// runnerCgroup is the leaf cgroup receiving the processes of the delegated
+// parent cgroup.
+const runnerCgroup = "runner"
+
+// enableControllers enables the memory and cpu controllers for the children
+// of the parent cgroup.
+// A cgroup containing processes can't enable controllers for its children:
+// its processes, like the runner started in the delegated cgroup, are moved
+// into a runner leaf cgroup first.
+func enableControllers(parent string) error {
+	data, err := os.ReadFile(filepath.Join(parent, "cgroup.procs"))
+	if err != nil {
+		return fmt.Errorf("read processes: %w", err)
+	}
+
+	if pids := strings.Fields(string(data)); len(pids) > 0 {
+		leaf := &Cgroup{Path: filepath.Join(parent, runnerCgroup)}
+		if err := leaf.Create(); err != nil {
+			return err
+		}
+		for _, pid := range pids {
+			// The process can exit meanwhile.
+			if err := leaf.write("cgroup.procs", pid); err != nil && !errors.Is(err, syscall.ESRCH) {
+				return fmt.Errorf("move process %s: %w", pid, err)
+			}
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+memory +cpu"), 0o644); err != nil {
+		return fmt.Errorf("enable controllers: %w", err)
+	}
+	return nil
+}
+
+// Create creates the cgroup and configures its limits.
+func (c *Cgroup) Create() error {
+	if err := os.Mkdir(c.Path, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("create cgroup: %w", err)
+	}
+
+	if c.MemMax > 0 {
+		if err := c.write("memory.max", strconv.FormatUint(c.MemMax, 10)); err != nil {
+			return err
+		}
+		// Without swap limit, the memory limit only slows the process down.
+		// Not all the kernels have swap accounting.
+		c.write("memory.swap.max", "0")
+	}
+
+	if c.CPUMax > 0 {
+		quota := int(c.CPUMax * cpuPeriod)
+		if err := c.write("cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OOMKills returns the number of processes of the cgroup killed by the OOM
+// killer, from memory.events.
+func (c *Cgroup) OOMKills() (int, error) {
+	f, err := os.Open(filepath.Join(c.Path, "memory.events"))
+	if err != nil {
+		return 0, fmt.Errorf("open memory.events: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || k != "oom_kill" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return 0, fmt.Errorf("parse oom_kill: %w", err)
+		}
+		return n, nil
+	}
+
+	return 0, scanner.Err()
+}
+
+// Remove deletes the cgroup. It must not contain processes anymore.
+func (c *Cgroup) Remove() error {
+	if err := os.Remove(c.Path); err != nil {
+		return fmt.Errorf("remove cgroup: %w", err)
+	}
+	return nil
+}
+
+func (c *Cgroup) write(name, value string) error {
+	if err := os.WriteFile(filepath.Join(c.Path, name), []byte(value), 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// attach is only available on linux.
+func (c *Cgroup) attach(cmd *exec.Cmd) (func(), error) {
+	return nil, fmt.Errorf("cgroups are only available on linux")
+}
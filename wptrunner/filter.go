@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Rule is a test selection pattern from an include or exclude file.
+// Patterns are globs matching the whole test URL, where ** matches any
+// characters, * any characters except / and ? a single character except /.
+// A \ escapes the next character to match it literally.
+// A pattern prefixed with re: is a regular expression matching a part of the
+// URL.
+type Rule struct {
+	Pattern string
+	// Source is the location of the rule: file:line.
+	Source string
+	// Matched counts the tests matched by the rule.
+	Matched int
+
+	re *regexp.Regexp
+}
+
+// NewRule compiles the pattern of a rule.
+func NewRule(pattern, source string) (*Rule, error) {
+	var expr string
+	if re, ok := strings.CutPrefix(pattern, "re:"); ok {
+		expr = re
+	} else {
+		expr = globRegexp(pattern)
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid pattern %q: %w", source, pattern, err)
+	}
+
+	return &Rule{Pattern: pattern, Source: source, re: re}, nil
+}
+
+// Match returns true if the rule matches the test URL.
+func (r *Rule) Match(u string) bool {
+	return r.re.MatchString(u)
+}
+
+// globRegexp converts a glob pattern into an anchored regular expression.
+// The tests URL start with a /, so it's added to the patterns missing it.
+func globRegexp(glob string) string {
+	if !strings.HasPrefix(glob, "/") && !strings.HasPrefix(glob, "*") {
+		glob = "/" + glob
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	return b.String()
+}
+
+// globEscape escapes the glob metacharacters of s, so the pattern matches s
+// only.
+func globEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '?', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// LoadRules reads the rules of a file, one pattern per line. Empty lines and
+// lines starting with # are ignored.
+func LoadRules(name string) ([]*Rule, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("open rules: %w", err)
+	}
+	defer f.Close()
+
+	var rules []*Rule
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		r, err := NewRule(line, fmt.Sprintf("%s:%d", name, n))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read rules: %w", err)
+	}
+
+	return rules, nil
+}
+
+// Selector selects the tests to run.
+type Selector struct {
+	// Filters are the include patterns, a test is selected if its URL
+	// contains one of them. All the tests are selected if empty.
+	Filters []string
+	// Exclude are the exclude patterns, see matchPattern.
+	Exclude []string
+
+	// IncludeRules select the tests matching at least one of them, if not
+	// empty.
+	IncludeRules []*Rule
+	// ExcludeRules exclude the tests matching one of them.
+	ExcludeRules []*Rule
+
+	// SkipTestdriver excludes the tests using testdriver.
+	SkipTestdriver bool
+	// OnlyAnyJS selects only the tests generated from .any.js files.
+	OnlyAnyJS bool
+}
+
+// Match returns true if the test is selected.
+func (s *Selector) Match(t Test) bool {
+	// The rules are checked first and all of them, so their counts cover
+	// all the tests.
+	included := len(s.IncludeRules) == 0 || matchRules(s.IncludeRules, t.URL)
+	excluded := matchRules(s.ExcludeRules, t.URL)
+
+	if s.SkipTestdriver && t.Meta.Testdriver {
+		return false
+	}
+
+	if s.OnlyAnyJS && !strings.HasSuffix(t.Meta.Path, ".any.js") {
+		return false
+	}
+
+	// apply filters (include patterns)
+	if len(s.Filters) > 0 {
+		matchFilter := false
+		for _, filter := range s.Filters {
+			if strings.Contains(t.URL, filter) {
+				matchFilter = true
+				break
+			}
+		}
+		if !matchFilter {
+			return false
+		}
+	}
+
+	// apply ignore patterns (exclude patterns)
+	for _, pattern := range s.Exclude {
+		if matchPattern(t.URL, pattern) {
+			return false
+		}
+	}
+
+	return included && !excluded
+}
+
+// matchRules returns true if one rule at least matches the URL. It counts
+// the matches of each rule.
+func matchRules(rules []*Rule, u string) bool {
+	var match bool
+	for _, r := range rules {
+		if r.Match(u) {
+			r.Matched++
+			match = true
+		}
+	}
+	return match
+}
+
+// Select returns the selected tests.
+func (s *Selector) Select(tests []Test) []Test {
+	selected := make([]Test, 0, len(tests))
+	for _, t := range tests {
+		if s.Match(t) {
+			selected = append(selected, t)
+		}
+	}
+	return selected
+}
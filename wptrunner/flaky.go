@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// outcomes counts the outcomes of the runs of a test or a subtest.
+type outcomes map[string]int
+
+// String returns the distribution, most frequent first: "Pass 3, Fail 2".
+func (o outcomes) String() string {
+	keys := make([]string, 0, len(o))
+	for k := range o {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if o[keys[i]] != o[keys[j]] {
+			return o[keys[i]] > o[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s %d", k, o[k]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// testRuns records the outcomes of the repeated runs of a test.
+type testRuns struct {
+	Name     string
+	Runs     int
+	Outcomes outcomes
+	// Cases are the subtests outcomes by occurrence.
+	Cases map[occurrence]outcomes
+}
+
+// occurrence identifies a subtest by its name and its rank among the
+// subtests of the same name.
+type occurrence struct {
+	Name string
+	N    int
+}
+
+// String returns the quoted name, with the rank of the duplicated names.
+func (o occurrence) String() string {
+	if o.N == 0 {
+		return strconv.Quote(o.Name)
+	}
+	return fmt.Sprintf("%q #%d", o.Name, o.N+1)
+}
+
+// Flaky returns true if the test or one of its subtests outcome varies.
+// A subtest missing from some runs counts as a variation.
+func (r *testRuns) Flaky() bool {
+	if len(r.Outcomes) > 1 {
+		return true
+	}
+	for _, o := range r.Cases {
+		if len(o) > 1 {
+			return true
+		}
+		for _, n := range o {
+			if n != r.Runs {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FlakyCases returns the subtests with varying outcomes, sorted.
+func (r *testRuns) FlakyCases() []occurrence {
+	var names []occurrence
+	for name, o := range r.Cases {
+		var n int
+		for _, c := range o {
+			n += c
+		}
+		if len(o) > 1 || n != r.Runs {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].Name != names[j].Name {
+			return names[i].Name < names[j].Name
+		}
+		return names[i].N < names[j].N
+	})
+	return names
+}
+
+// Repeats collects the results of tests run several times.
+type Repeats struct {
+	tests map[string]*testRuns
+	// order keeps the tests in their first result order.
+	order []*testRuns
+}
+
+func NewRepeats() *Repeats {
+	return &Repeats{tests: make(map[string]*testRuns)}
+}
+
+// Add records a test result.
+func (r *Repeats) Add(res *TestResult) {
+	t, ok := r.tests[res.Name]
+	if !ok {
+		t = &testRuns{
+			Name:     res.Name,
+			Outcomes: make(outcomes),
+			Cases:    make(map[occurrence]outcomes),
+		}
+		r.tests[res.Name] = t
+		r.order = append(r.order, t)
+	}
+
+	t.Runs++
+	t.Outcomes[res.Outcome()]++
+	// The duplicated subtest names are told apart by their rank.
+	seen := make(map[string]int, len(res.Cases))
+	for _, c := range res.Cases {
+		key := occurrence{Name: c.Name, N: seen[c.Name]}
+		seen[c.Name]++
+
+		o, ok := t.Cases[key]
+		if !ok {
+			o = make(outcomes)
+			t.Cases[key] = o
+		}
+		o[c.Format()]++
+	}
+}
+
+// Flaky returns the tests with varying outcomes.
+func (r *Repeats) Flaky() []*testRuns {
+	var flaky []*testRuns
+	for _, t := range r.order {
+		if t.Flaky() {
+			flaky = append(flaky, t)
+		}
+	}
+	return flaky
+}
+
+// writeFlaky writes the flaky tests report.
+func writeFlaky(w io.Writer, flaky []*testRuns) {
+	fmt.Fprintf(w, "\nFlaky tests: %d\n", len(flaky))
+	for _, t := range flaky {
+		fmt.Fprintf(w, "\t%q\t%s\n", t.Name, t.Outcomes)
+		for _, name := range t.FlakyCases() {
+			o := t.Cases[name]
+
+			var n int
+			for _, c := range o {
+				n += c
+			}
+			if n < t.Runs {
+				fmt.Fprintf(w, "\t\t%s\t%s, Missing %d\n", name, o, t.Runs-n)
+				continue
+			}
+			fmt.Fprintf(w, "\t\t%s\t%s\n", name, o)
+		}
+	}
+}
+
+// saveFlaky writes the flaky tests into the file, one test per line with its
+// outcomes as comment, so it can be used with --exclude-file.
+func saveFlaky(name string, flaky []*testRuns) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+
+	for _, t := range flaky {
+		if _, err := fmt.Fprintf(f, "# %s\n%s\n", t.Outcomes, globEscape(t.Name)); err != nil {
+			f.Close()
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+
+	return f.Close()
+}
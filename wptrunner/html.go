@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reportDir groups the results of a WPT directory in the HTML report.
+type reportDir struct {
+	Name    string
+	Pass    int
+	Total   int
+	Results []*TestResult
+}
+
+// Percent returns the subtests pass percentage of the directory.
+func (d *reportDir) Percent() float64 {
+	if d.Total == 0 {
+		return 0
+	}
+	return 100 * float64(d.Pass) / float64(d.Total)
+}
+
+// groupResults groups the results by first level directory, counting the
+// subtests like wptdiff completion: a test without subtests counts for one.
+func groupResults(results []*TestResult) []*reportDir {
+	var (
+		dirs []*reportDir
+		m    = make(map[string]*reportDir)
+	)
+
+	for _, res := range results {
+		name, _, _ := strings.Cut(strings.TrimPrefix(res.Name, "/"), "/")
+
+		d, ok := m[name]
+		if !ok {
+			d = &reportDir{Name: name}
+			m[name] = d
+			dirs = append(dirs, d)
+		}
+		d.Results = append(d.Results, res)
+
+		if ln := res.Total(); ln > 0 {
+			d.Total += ln
+			d.Pass += res.CountOK()
+		} else {
+			d.Total++
+			if res.Pass {
+				d.Pass++
+			}
+		}
+	}
+
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].Name < dirs[j].Name
+	})
+	for _, d := range dirs {
+		sort.Slice(d.Results, func(i, j int) bool {
+			if d.Results[i].Name != d.Results[j].Name {
+				return d.Results[i].Name < d.Results[j].Name
+			}
+			return d.Results[i].Run < d.Results[j].Run
+		})
+	}
+
+	return dirs
+}
+
+var reportTmpl = template.Must(template.New("report").Funcs(template.FuncMap{
+	"status": func(res *TestResult) string {
+		return res.Outcome()
+	},
+	"caseclass": func(c TestCase) string {
+		return FormatSuccess(c.Pass, false)
+	},
+	"ms": func(d time.Duration) int64 {
+		return d.Milliseconds()
+	},
+}).Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>WPT report</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { padding: 2px 6px; text-align: left; vertical-align: top; }
+tr.Pass .status { color: #080; }
+tr.Fail .status { color: #b00; }
+tr.Crash .status, tr.OOM .status { color: #fff; background: #b00; }
+.num { text-align: right; font-variant-numeric: tabular-nums; }
+.msg { color: #555; font-family: monospace; white-space: pre-wrap; }
+details.dir > summary { font-weight: bold; margin-top: .5em; cursor: pointer; }
+.bar { display: inline-block; width: 100px; height: .8em; background: #eee; }
+.bar span { display: block; height: 100%; background: #080; }
+#controls { position: sticky; top: 0; background: #fff; padding: .5em 0; }
+</style>
+</head>
+<body>
+<h1>WPT report</h1>
+<p>{{len .Results}} tests: {{.Pass}} pass, {{.Fail}} fail, {{.Crash}} crash. Generated {{.Date.Format "2006-01-02 15:04"}}.</p>
+<div id="controls">
+Status:
+<label><input type="checkbox" value="Pass" checked> Pass</label>
+<label><input type="checkbox" value="Fail" checked> Fail</label>
+<label><input type="checkbox" value="Crash" checked> Crash</label>
+<label><input type="checkbox" value="OOM" checked> OOM</label>
+| Sort by <select id="sort"><option value="name">name</option><option value="elapsed">elapsed</option></select>
+</div>
+{{range .Dirs}}
+<details class="dir">
+<summary>{{.Name}} <span class="bar"><span style="width: {{printf "%.0f" .Percent}}%"></span></span> {{printf "%.2f" .Percent}}% ({{.Pass}}/{{.Total}})</summary>
+<table>
+<thead><tr><th>Status</th><th class="num">Subtests</th><th class="num">Elapsed</th><th>Test</th></tr></thead>
+<tbody>
+{{range .Results}}
+<tr class="{{status .}}" data-name="{{.Name}}" data-elapsed="{{ms .Elapsed}}">
+<td class="status">{{status .}}</td>
+<td class="num">{{.CountOK}}/{{.Total}}</td>
+<td class="num">{{ms .Elapsed}}ms</td>
+<td>
+{{if or .Cases .Message .Log}}<details><summary>{{.Name}}{{with .Run}} (run {{.}}){{end}}</summary>
+{{with .Message}}<div class="msg">{{.}}</div>{{end}}
+{{with .Log}}<details><summary>log</summary><div class="msg">{{range .}}{{.}}
+{{end}}</div></details>{{end}}
+{{if .Cases}}<table>
+{{range .Cases}}<tr class="{{caseclass .}}"><td class="status">{{.Format}}</td><td>{{.Name}}{{with .Message}}<div class="msg">{{.}}</div>{{end}}{{with .Stack}}<details><summary>stack</summary><div class="msg">{{.}}</div></details>{{end}}</td></tr>
+{{end}}</table>{{end}}
+</details>{{else}}{{.Name}}{{with .Run}} (run {{.}}){{end}}{{end}}
+</td>
+</tr>
+{{end}}
+</tbody>
+</table>
+</details>
+{{end}}
+<script>
+(function() {
+	const boxes = document.querySelectorAll("#controls input");
+	function filter() {
+		const shown = new Set();
+		boxes.forEach(function(b) { if (b.checked) shown.add(b.value); });
+		document.querySelectorAll("tr[data-name]").forEach(function(tr) {
+			tr.hidden = !shown.has(tr.className);
+		});
+	}
+	boxes.forEach(function(b) { b.addEventListener("change", filter); });
+
+	document.getElementById("sort").addEventListener("change", function(e) {
+		const by = e.target.value;
+		document.querySelectorAll("details.dir > table > tbody").forEach(function(tbody) {
+			const rows = Array.from(tbody.children);
+			rows.sort(function(a, b) {
+				if (by === "elapsed") {
+					return Number(b.dataset.elapsed) - Number(a.dataset.elapsed);
+				}
+				return a.dataset.name < b.dataset.name ? -1 : 1;
+			});
+			rows.forEach(function(r) { tbody.appendChild(r); });
+		});
+	});
+})();
+</script>
+</body>
+</html>
+`))
+
+// writeHTML writes the self-contained HTML report of the results.
+func writeHTML(w io.Writer, results []*TestResult) error {
+	data := struct {
+		Results           []*TestResult
+		Dirs              []*reportDir
+		Pass, Fail, Crash int
+		Date              time.Time
+	}{
+		Results: results,
+		Dirs:    groupResults(results),
+		Date:    time.Now(),
+	}
+	for _, res := range results {
+		switch {
+		case res.Crash:
+			data.Crash++
+		case res.Pass:
+			data.Pass++
+		default:
+			data.Fail++
+		}
+	}
+
+	return reportTmpl.Execute(w, data)
+}
+
+// saveHTML writes the HTML report into the file.
+func saveHTML(name string, results []*TestResult) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+
+	if err := writeHTML(f, results); err != nil {
+		f.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sort"
+
+	"github.com/chromedp/cdproto/storage"
+	"github.com/chromedp/chromedp"
+)
+
+// newTestContext returns the chromedp context to run a test on the browser.
+// With isolate, the test runs in a dedicated browser context, disposed when
+// the returned context is canceled, so the tests don't share cookies, storage
+// and cache.
+func newTestContext(ctx context.Context, cdp string, isolate bool) (context.Context, context.CancelFunc, error) {
+	actx, acancel := chromedp.NewRemoteAllocator(ctx,
+		cdp, chromedp.NoModifyURL,
+	)
+
+	bctx, bcancel := chromedp.NewContext(actx)
+	if !isolate {
+		return bctx, func() {
+			bcancel()
+			acancel()
+		}, nil
+	}
+
+	// The browser connection must be initialized before creating a browser
+	// context.
+	if err := chromedp.Run(bctx); err != nil {
+		bcancel()
+		acancel()
+		return nil, nil, fmt.Errorf("connect: %w", err)
+	}
+
+	tctx, tcancel := chromedp.NewContext(bctx, chromedp.WithNewBrowserContext())
+	return tctx, func() {
+		tcancel()
+		bcancel()
+		acancel()
+	}, nil
+}
+
+// openTest returns the context to run the test on the browser, see
+// newTestContext, and checks the state leaks if enabled. The returned cancel
+// func records in the result if the CDP connection dropped.
+// A non nil result or error means the test can't run: the failure is
+// reported in the result, except a lost connection returned as error.
+func openTest(ctx context.Context, cdp string, t Test, opts RunOptions, res *TestResult) (context.Context, context.CancelFunc, *TestResult, error) {
+	tctx, cancel, err := newTestContext(ctx, cdp, opts.Isolate)
+	if err != nil {
+		if isConnError(err) {
+			return nil, nil, nil, fmt.Errorf("%s: %w", t.URL, err)
+		}
+		res.Message = err.Error()
+		return nil, nil, res, nil
+	}
+
+	if opts.LeakCheck {
+		res.Leak = leakedState(tctx, opts.Addr.Origins())
+	}
+
+	return tctx, func() {
+		res.lost = connLost(tctx)
+		cancel()
+	}, nil, nil
+}
+
+// connLost returns true if the CDP connection of the context dropped.
+func connLost(ctx context.Context) bool {
+	c := chromedp.FromContext(ctx)
+	if c == nil || c.Browser == nil {
+		return false
+	}
+
+	select {
+	case <-c.Browser.LostConnection:
+		return true
+	default:
+		return false
+	}
+}
+
+// leakedStorage are the storage types checked for leaks. The session storage
+// belongs to the page, each test has a new one.
+var leakedStorage = []storage.Type{
+	storage.TypeLocalStorage,
+	storage.TypeIndexeddb,
+	storage.TypeCacheStorage,
+	storage.TypeServiceWorkers,
+	storage.TypeFileSystems,
+}
+
+// leakedState returns the cookies and the storage of the origins present in
+// the browser context before the test starts: they were left by the previous
+// tests.
+// The check is a best effort, errors are ignored. In a shared browser
+// context, it's only meaningful when the tests run one at a time: with
+// concurrent tests, the state of the running ones would be reported. With
+// isolation, it checks the new browser context is empty.
+func leakedState(ctx context.Context, origins []string) []string {
+	leaked := leakedCookies(ctx)
+
+	for _, origin := range origins {
+		err := chromedp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+			_, _, _, usage, err := storage.GetUsageAndQuota(origin).Do(ctx)
+			if err != nil {
+				return err
+			}
+			for _, u := range usage {
+				if u.Usage > 0 && slices.Contains(leakedStorage, u.StorageType) {
+					leaked = append(leaked, fmt.Sprintf("%s %dB (%s)", u.StorageType, int64(u.Usage), origin))
+				}
+			}
+			return nil
+		}))
+		if err != nil {
+			slog.Debug("leak check", slog.String("origin", origin), slog.Any("err", err))
+		}
+	}
+
+	sort.Strings(leaked)
+	return leaked
+}
+
+// leakedCookies returns the cookies present in the browser context.
+func leakedCookies(ctx context.Context) []string {
+	var leaked []string
+	err := chromedp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+		p := storage.GetCookies()
+		if c := chromedp.FromContext(ctx); c != nil && c.BrowserContextID != "" {
+			p = p.WithBrowserContextID(c.BrowserContextID)
+		}
+
+		cookies, err := p.Do(ctx)
+		if err != nil {
+			return err
+		}
+		for _, c := range cookies {
+			leaked = append(leaked, fmt.Sprintf("cookie %s (%s)", c.Name, c.Domain))
+		}
+		return nil
+	}))
+	if err != nil {
+		slog.Debug("leak check", slog.Any("err", err))
+		return nil
+	}
+
+	return leaked
+}
+
+// writeLeaks writes the tests started with a state left by previous tests.
+func writeLeaks(w io.Writer, leaks []*TestResult) {
+	fmt.Fprintf(w, "\nState leaks: %d\n", len(leaks))
+	for _, res := range leaks {
+		fmt.Fprintf(w, "\t%q\n", res.Name)
+		for _, l := range res.Leak {
+			fmt.Fprintf(w, "\t\t%s\n", l)
+		}
+	}
+}
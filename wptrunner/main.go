@@ -20,14 +20,20 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"log"
 	"log/slog"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/chromedp/cdproto/page"
 	"github.com/chromedp/chromedp"
 	"golang.org/x/sync/errgroup"
 )
@@ -111,19 +117,49 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 	flags.SetOutput(stderr)
 
 	var (
-		verbose     = flags.Bool("verbose", false, "enable debug log level")
-		wptAddr     = flags.String("wpt-addr", env("WPT_ADDR", WPTAddrDefault), "WPT server address")
-		cdp         = flags.String("cdp", env("CDP_WS", CdpWSDefault), "cdp ws to connect, incompatible w/ lpdpath")
-		concurrency = flags.Uint("concurrency", 10, "concurrency tests runner")
-		outjson     = flags.Bool("json", false, "format output in JSON")
-		outsummary  = flags.Bool("summary", false, "Display a summary")
-		lpdpath     = flags.String("lpd-path", os.Getenv("LPD_PATH"), "Lightpanda path. If set, it enables autorestart lightpanda process.")
-		pool        = flags.Uint("pool", 1, "browser pool, lpd-path is required, concurrency must be greater or equal to pool")
-		ml          = flags.Uint("mem-limit", 0, "memory limit for a browser, in MB, only for linux")
-		list        = flags.Bool("list", false, "Only list test cases")
-		exclude     stringSliceFlag
+		verbose        = flags.Bool("verbose", false, "enable debug log level")
+		wptAddr        = flags.String("wpt-addr", env("WPT_ADDR", WPTAddrDefault), "WPT server address")
+		cdp            = flags.String("cdp", env("CDP_WS", CdpWSDefault), "cdp ws to connect, incompatible w/ lpdpath")
+		refcdp         = flags.String("ref-cdp", "", "cdp ws of a reference browser, each test is run on it too to report the tests passing on the reference only")
+		concurrency    = flags.Uint("concurrency", 10, "concurrency tests runner")
+		outjson        = flags.Bool("json", false, "format output in JSON")
+		outndjson      = flags.Bool("ndjson", false, "format output in JSON, one test result per line")
+		outsummary     = flags.Bool("summary", false, "Display a summary")
+		lpdpath        = flags.String("lpd-path", os.Getenv("LPD_PATH"), "Lightpanda path. If set, it enables autorestart lightpanda process.")
+		pool           = flags.Uint("pool", 1, "browser pool, lpd-path is required, concurrency must be greater or equal to pool")
+		maxload        = flags.Uint("browser-concurrency", 0, "max concurrent tests per browser of the pool, 0 for no limit, lpd-path is required")
+		ml             = flags.Uint("mem-limit", 0, "memory limit for a browser, in MB, only for linux")
+		cgroup         = flags.String("cgroup", "", "delegated cgroup v2 directory where a cgroup is created per browser, lpd-path is required, only for linux")
+		cgroupMem      = flags.Uint("cgroup-mem", 0, "memory limit of a browser cgroup, in MB, requires --cgroup")
+		cgroupCPU      = flags.Float64("cgroup-cpu", 0, "CPU limit of a browser cgroup, in number of CPUs, requires --cgroup")
+		list           = flags.Bool("list", false, "Only list test cases")
+		skipTestdriver = flags.Bool("skip-testdriver", false, "skip the tests requiring testdriver")
+		testdriver     = flags.Bool("testdriver", false, "execute the testdriver actions over CDP")
+		onlyAnyJS      = flags.Bool("only-any-js", false, "run only the tests generated from .any.js files")
+		serve          = flags.String("serve", "", "serve the WPT checkout directory with the built-in server instead of using wpt-addr")
+		serveAddr      = flags.String("serve-addr", "127.0.0.1:8000", "listen address of the built-in WPT server")
+		types          = flags.String("types", TypeTestharness, "comma separated list of test types to run: testharness, crashtest, reftest, print-reftest")
+		confirm        = flags.Bool("confirm-crashes", false, "run again crashing tests in isolation to confirm the crash")
+		profiling      = flags.Bool("profile", false, "sample the browser memory and CPU usage during each test, lpd-path is required, only for linux")
+		topmem         = flags.Uint("top-mem", 0, "report the N tests growing the browser memory the most, implies --profile, the growth is shared by the concurrent tests")
+		showProgress   = flags.Bool("progress", false, "display a status line of the run on stderr, if it's a terminal")
+		htmlOut        = flags.String("html", "", "write a HTML report of the results into the file")
+		repeat         = flags.Uint("repeat", 1, "run each test N times and report the flaky tests")
+		isolate        = flags.Bool("isolate", false, "run each test in its own browser context")
+		leakCheck      = flags.Bool("leak-check", false, "report the cookies, local storage, IndexedDB and cache left by the previous tests before each test, requires --concurrency 1 or --isolate to check the isolation")
+		timeoutsFile   = flags.String("timeouts", "", "JSON file configuring the timeouts per path pattern")
+		timeout        = flags.Duration("timeout", 0, "total timeout of a test, overrides the timeouts file")
+		longTimeout    = flags.Duration("long-timeout", 0, "total timeout of a long test, overrides the timeouts file")
+		grace          = flags.Duration("grace", 0, "max duration without subtest result, overrides the timeouts file")
+		probeInterval  = flags.Duration("probe-interval", 0, "delay between two probes of a test progress, overrides the timeouts file")
+		flakyFile      = flags.String("flaky-file", "", "write the flaky tests into the file, usable with --exclude-file, requires --repeat")
+		exclude        stringSliceFlag
+		includeFiles   stringSliceFlag
+		excludeFiles   stringSliceFlag
 	)
 	flags.Var(&exclude, "exclude", "exclude pattern (can be specified multiple times, supports *wildcards*)")
+	flags.Var(&includeFiles, "include-file", "file of include patterns, one per line, supports globs and re: regexps (can be specified multiple times)")
+	flags.Var(&excludeFiles, "exclude-file", "file of exclude patterns, one per line, supports globs and re: regexps (can be specified multiple times)")
 
 	// usage func declaration.
 	bin := args[0]
@@ -145,10 +181,31 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 		slog.SetLogLoggerLevel(slog.LevelDebug)
 	}
 
+	if *outjson && *outndjson {
+		return fmt.Errorf("--json and --ndjson options are incompatible")
+	}
+
+	if *repeat == 0 {
+		return fmt.Errorf("--repeat must be greater than 0")
+	}
+
+	if *flakyFile != "" && *repeat < 2 {
+		return fmt.Errorf("--repeat is required for --flaky-file option")
+	}
+
+	// Without isolation, the state of the running tests would be reported.
+	if *leakCheck && !*isolate && *concurrency != 1 {
+		return fmt.Errorf("--leak-check option requires --concurrency 1 or --isolate")
+	}
+
 	if *pool > 1 && *lpdpath == "" {
 		return fmt.Errorf("--lp-path is required for --pool option")
 	}
 
+	if *maxload > 0 && *lpdpath == "" {
+		return fmt.Errorf("--lp-path is required for --browser-concurrency option")
+	}
+
 	if *ml > 0 && *lpdpath == "" {
 		return fmt.Errorf("--lp-path is required for --mem-limit option")
 	}
@@ -157,23 +214,132 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 		return fmt.Errorf("--mem-limit option is availble only on linux os")
 	}
 
+	if *cgroup != "" && *lpdpath == "" {
+		return fmt.Errorf("--lp-path is required for --cgroup option")
+	}
+
+	if *cgroup != "" && runtime.GOOS != "linux" {
+		return fmt.Errorf("--cgroup option is availble only on linux os")
+	}
+
+	if (*cgroupMem > 0 || *cgroupCPU > 0) && *cgroup == "" {
+		return fmt.Errorf("--cgroup is required for --cgroup-mem and --cgroup-cpu options")
+	}
+
+	if (*profiling || *topmem > 0) && *lpdpath == "" {
+		return fmt.Errorf("--lp-path is required for --profile option")
+	}
+
+	if (*profiling || *topmem > 0) && runtime.GOOS != "linux" {
+		return fmt.Errorf("--profile option is availble only on linux os")
+	}
+
+	timeouts := DefaultTimeoutConfig()
+	if *timeoutsFile != "" {
+		var err error
+		if timeouts, err = LoadTimeoutConfig(*timeoutsFile); err != nil {
+			return fmt.Errorf("timeouts: %w", err)
+		}
+	}
+	timeouts.Override = Timeouts{
+		Timeout:       Duration(*timeout),
+		LongTimeout:   Duration(*longTimeout),
+		Grace:         Duration(*grace),
+		ProbeInterval: Duration(*probeInterval),
+	}
+
+	testtypes := strings.Split(*types, ",")
+	for _, typ := range testtypes {
+		switch typ {
+		case TypeTestharness, TypeCrashtest, TypeReftest, TypePrintReftest:
+		default:
+			return fmt.Errorf("invalid test type: %q", typ)
+		}
+	}
+
 	filters := flags.Args()
 
+	// start the built-in WPT server.
+	if *serve != "" {
+		srv := &Server{Root: *serve}
+		addr, err := srv.Start(*serveAddr)
+		if err != nil {
+			return fmt.Errorf("wpt server: %w", err)
+		}
+		defer srv.Stop(context.Background())
+
+		slog.Info("wpt server", slog.String("root", *serve), slog.String("addr", addr))
+		*wptAddr = addr
+	}
+
 	// fetch the manifest
-	tests, err := fetchManifest(ctx, *wptAddr)
+	tests, err := fetchManifest(ctx, *wptAddr, testtypes)
 	if err != nil {
 		return fmt.Errorf("manifest: %w", err)
 	}
 	slog.Info("test suite", slog.Any("length", len(tests)))
 
-	// Only list all tests.
+	selector := Selector{
+		Filters:        filters,
+		Exclude:        exclude,
+		SkipTestdriver: *skipTestdriver,
+		OnlyAnyJS:      *onlyAnyJS,
+	}
+	for _, f := range includeFiles {
+		rules, err := LoadRules(f)
+		if err != nil {
+			return fmt.Errorf("include file: %w", err)
+		}
+		selector.IncludeRules = append(selector.IncludeRules, rules...)
+	}
+	for _, f := range excludeFiles {
+		rules, err := LoadRules(f)
+		if err != nil {
+			return fmt.Errorf("exclude file: %w", err)
+		}
+		selector.ExcludeRules = append(selector.ExcludeRules, rules...)
+	}
+
+	tests = selector.Select(tests)
+	slog.Info("selected tests", slog.Any("length", len(tests)))
+
+	for _, r := range append(selector.IncludeRules, selector.ExcludeRules...) {
+		slog.Info("rule", slog.String("source", r.Source), slog.String("pattern", r.Pattern), slog.Int("matched", r.Matched))
+	}
+
+	// Only list the tests.
 	if *list {
+		if *outjson {
+			return json.NewEncoder(stdout).Encode(tests)
+		}
+
+		if *outndjson {
+			enc := json.NewEncoder(stdout)
+			for _, t := range tests {
+				if err := enc.Encode(t); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
 		for _, t := range tests {
 			fmt.Fprintf(stdout, "%s\n", t.URL)
 		}
 		return nil
 	}
 
+	// confirmed and collateral list the crashing tests after their run in
+	// isolation.
+	var confirmed, collateral []string
+
+	// the reference browser's websocket URL.
+	var reference string
+	if *refcdp != "" {
+		reference = resolveCDP(ctx, *refcdp)
+		slog.Info("reference browser", slog.String("cdp", reference))
+	}
+
 	// queue channel is used to dispatch the tests from the producer to runners.
 	queue := make(chan Test)
 	// testresults channel pipes test results from the runners to the reporter.
@@ -184,15 +350,38 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 
 	wg, ctx := errgroup.WithContext(ctx)
 
+	// newCgroup returns the cgroup of the browser listening on the port.
+	newCgroup := func(port int) *Cgroup {
+		if *cgroup == "" {
+			return nil
+		}
+		return &Cgroup{
+			Path:   filepath.Join(*cgroup, fmt.Sprintf("browser-%d", port)),
+			MemMax: uint64(*cgroupMem) * 1024 * 1024,
+			CPUMax: *cgroupCPU,
+		}
+	}
+	if *cgroup != "" {
+		if err := enableControllers(*cgroup); err != nil {
+			return fmt.Errorf("cgroup: %w", err)
+		}
+	}
+
 	var browser Browser = NoopBrowser{CDP: *cdp}
 	if *lpdpath != "" {
-		if *pool > 1 {
-			browser = NewPoolBrowser(*lpdpath, *pool, *ml)
+		if *pool > 1 || *maxload > 0 {
+			pb := NewPoolBrowser(*lpdpath, *pool, *ml)
+			pb.MaxLoad = *maxload
+			for _, p := range pb.procs {
+				p.Cgroup = newCgroup(p.Port)
+			}
+			browser = pb
 		} else {
 			browser = &ProcessBrowser{
 				Port:     9222,
 				Path:     *lpdpath,
 				Memlimit: *ml,
+				Cgroup:   newCgroup(9222),
 			}
 		}
 	}
@@ -203,39 +392,43 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 	}
 	defer browser.Stop()
 
+	var progress *Progress
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	defer stopProgress()
+	if *showProgress {
+		if f, ok := stderr.(*os.File); ok {
+			progress = NewProgress(f, len(tests)*int(*repeat), browser.Restarts)
+		}
+		if progress == nil {
+			slog.Info("progress disabled, stderr is not a terminal")
+		} else {
+			// The logs must clear the status line too.
+			log.SetOutput(progress.Writer())
+			defer log.SetOutput(stderr)
+
+			go progress.Run(progressCtx)
+		}
+	}
+
 	// start the producer which append tests urls into queue.
+	// With repeat, all the tests are queued once before queuing them again,
+	// to spread the runs of a test over the whole run.
 	wg.Go(func() error {
 		defer close(queue)
 
-		hasFilters := len(filters) > 0
-
-	NEXT:
-		for _, t := range tests {
-			// apply filters (include patterns)
-			matchFilter := false
-			for _, filter := range filters {
-				if strings.Contains(t.URL, filter) {
-					matchFilter = true
-					break
+		for round := range *repeat {
+			for _, t := range tests {
+				if *repeat > 1 {
+					t.Run = int(round) + 1
 				}
-			}
-			if hasFilters && !matchFilter {
-				continue
-			}
 
-			// apply ignore patterns (exclude patterns)
-			for _, pattern := range exclude {
-				if matchPattern(t.URL, pattern) {
-					continue NEXT
+				select {
+				case <-ctx.Done():
+					return nil
+				case queue <- t:
+					// nothing here
 				}
 			}
-
-			select {
-			case <-ctx.Done():
-				return nil
-			case queue <- t:
-				// nothing here
-			}
 		}
 		return nil
 	})
@@ -244,22 +437,35 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 	// test and publish result into testresults.
 	wg.Go(func() error {
 		defer close(testresults)
-		pool, ctx := errgroup.WithContext(ctx)
+		pool, pctx := errgroup.WithContext(ctx)
 
 		wptAddrHttps := strings.Replace(*wptAddr, "http://", "https://", 1)
 
-		addr := Address{
-			http:  *wptAddr,
-			https: strings.Replace(wptAddrHttps, ":8000", ":8443", 1),
-			http2: strings.Replace(wptAddrHttps, ":8000", ":9000", 1),
+		opts := RunOptions{
+			Addr: Address{
+				http:  *wptAddr,
+				https: strings.Replace(wptAddrHttps, ":8000", ":8443", 1),
+				http2: strings.Replace(wptAddrHttps, ":8000", ":9000", 1),
+			},
+			Profile:    *profiling || *topmem > 0,
+			Testdriver: *testdriver,
+			Timeouts:   timeouts,
+			Isolate:    *isolate,
+			LeakCheck:  *leakCheck,
 		}
 
+		// suspects are the tests crashing, they are run again in isolation
+		// to confirm the crash.
+		var (
+			mu       sync.Mutex
+			suspects []Test
+		)
+
 		for range *concurrency {
 			pool.Go(func() error {
 				for {
-					var cdp string
 					select {
-					case <-ctx.Done():
+					case <-pctx.Done():
 						return nil
 					case t, ok := <-queue:
 						if !ok {
@@ -267,87 +473,128 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 						}
 
 						slog.Debug("wait for browser readyness", slog.String("test", t.URL))
-						select {
-						case <-ctx.Done():
+						lease, ok := <-browser.Ready(pctx, t.URL)
+						if !ok {
 							return nil
-						case cdp, _ = <-browser.Ready():
-							// continue
 						}
 
-						res, err := runtest(ctx, cdp, t, addr)
-						if err != nil {
-							// We use debug here to avoid useless output.
-							slog.Debug("run test error", slog.String("test", t.URL), slog.Any("err", err))
-
-							// we start the browser again and continue to next tests
-							res = &TestResult{
-								Name:    t.URL,
-								Message: err.Error(),
-
-								// This is not always the test which really
-								// crash. Because of the concurrency, we don't
-								// detect the crash test exactly. But the test
-								// fails b/c the browser was missing, mostly
-								// due to a previous crash...
-								Crash: true,
-							}
+						end := progress.Start(t.URL)
+						res := exectest(pctx, lease, t, opts)
+						lease.Done()
+						if reference != "" {
+							res.Reference = runReference(pctx, reference, t, opts)
+						}
+						end()
+
+						if res.Crash && *confirm {
+							// The crash will be confirmed once all the
+							// tests are done.
+							mu.Lock()
+							suspects = append(suspects, t)
+							mu.Unlock()
+							continue
 						}
 						testresults <- res
 					}
 				}
 			})
 		}
-		return pool.Wait()
+		if err := pool.Wait(); err != nil {
+			return err
+		}
+
+		// Run the suspected tests one by one. Since no other test runs
+		// concurrently, a crash here is caused by the test itself.
+		for _, t := range suspects {
+			lease, ok := <-browser.Ready(ctx, t.URL)
+			if !ok {
+				return nil
+			}
+
+			end := progress.Start(t.URL)
+			res := exectest(ctx, lease, t, opts)
+			lease.Done()
+			if reference != "" {
+				res.Reference = runReference(ctx, reference, t, opts)
+			}
+			end()
+
+			if res.Crash {
+				confirmed = append(confirmed, res.Name)
+			} else {
+				res.Collateral = true
+				collateral = append(collateral, res.Name)
+			}
+			testresults <- res
+		}
+
+		return nil
 	})
 
+	// results keeps the test results for the final reports.
+	var results []*TestResult
+
+	// behind lists the tests failing, but passing on the reference browser.
+	var behind []*TestResult
+
+	// leaks lists the tests started with a state left by previous tests.
+	var leaks []*TestResult
+
+	// repeats collects the outcomes of the repeated tests.
+	var repeats *Repeats
+	if *repeat > 1 {
+		repeats = NewRepeats()
+	}
+
 	// start the reporter reading testresults.
 	wg.Go(func() error {
 		var encoder *json.Encoder
 		if *outjson {
 			fmt.Fprint(stdout, "[")
 			defer fmt.Fprint(stdout, "]")
+		}
+		if *outjson || *outndjson {
 			encoder = json.NewEncoder(stdout)
 		}
 
 		first := true
 		for res := range testresults {
-			if *outjson {
-				if first {
-					first = false
-				} else {
-					fmt.Fprint(stdout, ",")
-				}
-				encoder.Encode(res)
-				continue
-			}
+			progress.Done(res)
 
-			// text output
-			if *outsummary || res.Message == "" {
-				fmt.Fprintf(stdout, "%s %d/%d\t%q\n",
-					FormatSuccess(res.Pass, res.Crash), res.CountOK(), res.Total(), res.Name,
-				)
-			} else {
-				fmt.Fprintf(stdout, "%s %d/%d\t%q\n\t%q\n",
-					FormatSuccess(res.Pass, res.Crash), res.CountOK(), res.Total(), res.Name, res.Message,
-				)
+			if *topmem > 0 || *htmlOut != "" {
+				results = append(results, res)
 			}
-
-			if *outsummary {
-				continue
+			if repeats != nil {
+				repeats.Add(res)
+			}
+			if ref := res.Reference; ref != nil && ref.Pass && !res.Pass {
+				behind = append(behind, res)
+			}
+			if len(res.Leak) > 0 {
+				leaks = append(leaks, res)
 			}
 
-			// Details
-			for _, c := range res.Cases {
-				if c.Message == "" {
-					fmt.Fprintf(stdout, "\t%s\t%q\n",
-						FormatSuccess(c.Pass, false), c.Name,
-					)
-				} else {
-					fmt.Fprintf(stdout, "\t%s\t%q\n\t\t%q\n",
-						FormatSuccess(c.Pass, false), c.Name, c.Message,
-					)
+			progress.Print(func() {
+				if *outjson {
+					if first {
+						first = false
+					} else {
+						fmt.Fprint(stdout, ",")
+					}
+					encoder.Encode(res)
+					return
 				}
-			}
+
+				if *outndjson {
+					// The encoder writes each result with its new line in
+					// one unbuffered write, so an interrupted run keeps the
+					// previous results readable.
+					encoder.Encode(res)
+					return
+				}
+
+				writeResult(stdout, res, *outsummary)
+			})
 		}
 
 		return nil
@@ -357,15 +604,93 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 		return fmt.Errorf("wg: %w", err)
 	}
 
+	stopProgress()
+	progress.Stop()
+
+	// Final reports are written on stderr with JSON output to keep it valid.
+	out := stdout
+	if *outjson || *outndjson {
+		out = stderr
+	}
+
+	if *confirm {
+		fmt.Fprintf(out, "\nConfirmed crashes: %d\n", len(confirmed))
+		for _, name := range confirmed {
+			fmt.Fprintf(out, "\t%q\n", name)
+		}
+		fmt.Fprintf(out, "Collateral crashes: %d\n", len(collateral))
+		for _, name := range collateral {
+			fmt.Fprintf(out, "\t%q\n", name)
+		}
+	}
+
+	if reference != "" {
+		writeReference(out, behind)
+	}
+
+	if len(leaks) > 0 {
+		writeLeaks(out, leaks)
+	}
+
+	if repeats != nil {
+		flaky := repeats.Flaky()
+		writeFlaky(out, flaky)
+
+		if *flakyFile != "" {
+			if err := saveFlaky(*flakyFile, flaky); err != nil {
+				return fmt.Errorf("flaky file: %w", err)
+			}
+		}
+	}
+
+	if *htmlOut != "" {
+		if err := saveHTML(*htmlOut, results); err != nil {
+			return fmt.Errorf("html report: %w", err)
+		}
+	}
+
+	// The browser is shared by the tests: its absolute memory depends on
+	// the tests run before, rank by the growth during the test.
+	if *topmem > 0 {
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].RSSGrowth > results[j].RSSGrowth
+		})
+
+		fmt.Fprintf(out, "\nTop memory growth:\n")
+		for _, res := range results[:min(int(*topmem), len(results))] {
+			fmt.Fprintf(out, "\t+%5dMB\t%6dMB\t%8s\t%q\n",
+				res.RSSGrowth/(1024*1024), res.MaxRSS/(1024*1024), res.CPU.Round(time.Millisecond), res.Name,
+			)
+		}
+	}
+
 	browser.Stop()
 
 	return nil
 }
 
+// Status is the outcome of a subtest, as formatted by testharness.
+type Status string
+
+const (
+	StatusPass        Status = "Pass"
+	StatusFail        Status = "Fail"
+	StatusTimeout     Status = "Timeout"
+	StatusNotRun      Status = "Not Run"
+	StatusUnsupported Status = "Optional Feature Unsupported"
+)
+
+// harnessStatus maps the testharness Test status enum to the statuses.
+var harnessStatus = []Status{
+	StatusPass, StatusFail, StatusTimeout, StatusNotRun, StatusUnsupported,
+}
+
 type TestCase struct {
 	Pass    bool   `json:"pass"`
 	Name    string `json:"name"`
+	Status  Status `json:"status"`
 	Message string `json:"message,omitempty"`
+	Stack   string `json:"stack,omitempty"`
 }
 
 type TestResult struct {
@@ -375,6 +700,92 @@ type TestResult struct {
 	Message string        `json:"message,omitempty"`
 	Cases   []TestCase    `json:"cases"`
 	Elapsed time.Duration `json:"elapsed"`
+
+	// Exit describes the browser's exit on crash.
+	Exit *Exit `json:"exit,omitempty"`
+	// OOM is set when the crash is an OOM kill of the browser's cgroup.
+	OOM bool `json:"oom,omitempty"`
+	// Collateral is set when the test crashed, but passed the crash
+	// confirmation: another test crashed the browser.
+	Collateral bool `json:"collateral,omitempty"`
+
+	// MaxRSS is the peak resident memory of the browser during the test, in
+	// bytes.
+	MaxRSS uint64 `json:"max_rss,omitempty"`
+	// RSSGrowth is the growth of the browser resident memory during the
+	// test: the peak minus the resident memory at its start, in bytes.
+	RSSGrowth uint64 `json:"rss_growth,omitempty"`
+	// CPU is the CPU time consumed by the browser during the test.
+	CPU time.Duration `json:"cpu,omitempty"`
+
+	// Meta is the test metadata from the manifest.
+	Meta *Meta `json:"meta,omitempty"`
+	// Run is the index of the run of the test with --repeat, from 1.
+	Run int `json:"run,omitempty"`
+
+	// Reference is the result of the test on the reference browser.
+	Reference *TestResult `json:"reference,omitempty"`
+
+	// Log is the console, exceptions and failed requests log of a failing
+	// test.
+	Log []LogEntry `json:"log,omitempty"`
+
+	// Leak lists the state left by the previous tests found when the test
+	// started.
+	Leak []string `json:"leak,omitempty"`
+
+	// lost is set when the CDP connection dropped during the test.
+	lost bool
+}
+
+// writeResult writes the result in text format.
+func writeResult(w io.Writer, res *TestResult, summary bool) {
+	if summary || res.Message == "" {
+		fmt.Fprintf(w, "%s %d/%d\t%q\n",
+			res.Outcome(), res.CountOK(), res.Total(), res.Name,
+		)
+	} else {
+		fmt.Fprintf(w, "%s %d/%d\t%q\n\t%q\n",
+			res.Outcome(), res.CountOK(), res.Total(), res.Name, res.Message,
+		)
+	}
+
+	if summary {
+		return
+	}
+
+	for _, l := range res.Log {
+		fmt.Fprintf(w, "\t%q\n", l.String())
+	}
+
+	// Details
+	for _, c := range res.Cases {
+		if c.Message == "" {
+			fmt.Fprintf(w, "\t%s\t%q\n",
+				c.Format(), c.Name,
+			)
+		} else {
+			fmt.Fprintf(w, "\t%s\t%q\n\t\t%q\n",
+				c.Format(), c.Name, c.Message,
+			)
+		}
+	}
+}
+
+// Format returns the subtest status.
+func (c TestCase) Format() string {
+	if c.Status != "" {
+		return string(c.Status)
+	}
+	return FormatSuccess(c.Pass, false)
+}
+
+// Outcome returns the test outcome: Pass, Fail, Crash or OOM.
+func (r *TestResult) Outcome() string {
+	if r.OOM {
+		return "OOM"
+	}
+	return FormatSuccess(r.Pass, r.Crash)
 }
 
 func FormatSuccess(pass bool, crash bool) string {
@@ -404,38 +815,129 @@ func (r *TestResult) CountOK() int {
 	return cpt
 }
 
+// exitWait is the max duration to wait for the browser's exit after a
+// connection error.
+const exitWait = time.Second
+
+// exectest runs the test on the leased browser. A test which fails to
+// communicate with the browser is reported as a crash.
+func exectest(ctx context.Context, lease *Lease, t Test, opts RunOptions) *TestResult {
+	var stop func() (uint64, uint64, time.Duration)
+	if opts.Profile {
+		stop = lease.Profile()
+	}
+
+	var (
+		res *TestResult
+		err error
+	)
+	switch t.Type {
+	case TypeCrashtest:
+		res, err = runcrashtest(ctx, lease.CDP, t, opts)
+	case TypeReftest, TypePrintReftest:
+		res, err = runreftest(ctx, lease.CDP, t, opts)
+	default:
+		res, err = runtest(ctx, lease.CDP, t, opts)
+	}
+
+	var (
+		rss0, maxrss uint64
+		cpu          time.Duration
+	)
+	if stop != nil {
+		rss0, maxrss, cpu = stop()
+	}
+
+	if err == nil {
+		res.MaxRSS, res.RSSGrowth, res.CPU = maxrss, maxrss-rss0, cpu
+		res.Meta = &t.Meta
+		res.Run = t.Run
+
+		// The connection to a crashing browser doesn't always end with a
+		// connection error. Give time to the browser to exit if the
+		// connection dropped.
+		if !res.Pass {
+			var wait time.Duration
+			if res.lost {
+				wait = exitWait
+			}
+			if exit := lease.Exit(wait); exit != nil {
+				res.Crash = true
+				res.OOM = exit.OOM
+				if res.Message != "" {
+					res.Message += ": "
+				}
+				res.Message += exit.String()
+				res.Exit = exit
+			}
+		}
+		return res
+	}
+
+	// We use debug here to avoid useless output.
+	slog.Debug("run test error", slog.String("test", t.URL), slog.Any("err", err))
+
+	// This is not always the test which really crash. Because of the
+	// concurrency, the test can fail b/c the browser crashed due to another
+	// test. Use --confirm-crashes to run the crashing tests in isolation.
+	res = &TestResult{
+		Name:      t.URL,
+		Message:   err.Error(),
+		Crash:     true,
+		MaxRSS:    maxrss,
+		RSSGrowth: maxrss - rss0,
+		CPU:       cpu,
+		Meta:      &t.Meta,
+		Run:       t.Run,
+	}
+	if exit := lease.Exit(exitWait); exit != nil {
+		res.OOM = exit.OOM
+		res.Message += ": " + exit.String()
+		res.Exit = exit
+	}
+
+	return res
+}
+
 // runtest connect to the browser, navigates to the test url and get the test
 // results.
-func runtest(ctx context.Context, cdp string, test Test, addr Address) (*TestResult, error) {
-	base := addr.http
-	if strings.Contains(test.URL, ".https.") {
-		base = addr.https
-	} else if strings.Contains(test.URL, ".h2.") {
-		base = addr.http2
-	}
-	u := base + test.URL
+func runtest(ctx context.Context, cdp string, test Test, opts RunOptions) (*TestResult, error) {
+	u := opts.Addr.URL(test.URL, test.Meta.Scheme())
 	slog.Debug("run test", slog.String("test", test.URL), slog.String("cdp", cdp), slog.String("url", u))
 
 	res := &TestResult{Name: test.URL}
 
-	timeout := CDPTimeout
-	if test.Long {
-		timeout = LongTimeout
-	}
+	tm := opts.Timeouts.For(test)
 
-	ctx, cancel := context.WithTimeout(ctx, timeout)
+	ctx, cancel := context.WithTimeout(ctx, tm.Total(test.Long))
 	defer cancel()
 
-	ctx, cancel = chromedp.NewRemoteAllocator(ctx,
-		cdp, chromedp.NoModifyURL,
-	)
+	ctx, cancel, done, err := openTest(ctx, cdp, test, opts, res)
+	if done != nil || err != nil {
+		return done, err
+	}
 	defer cancel()
 
-	ctx, cancel = chromedp.NewContext(ctx)
-	defer cancel()
+	// The page log is kept for the failing tests only.
+	plog := capturePageLog(ctx)
+	defer func() {
+		if !res.Pass {
+			res.Log = plog.Entries()
+		}
+	}()
+
+	if opts.Testdriver && test.Meta.Testdriver {
+		if err := enableTestdriver(ctx); err != nil {
+			if isConnError(err) {
+				return nil, fmt.Errorf("%s: testdriver: %w", test.URL, err)
+			}
+			res.Message = fmt.Sprintf("testdriver: %s", err)
+			return res, nil
+		}
+	}
 
 	start := time.Now()
-	err := chromedp.Run(ctx, chromedp.Navigate(u))
+	err = chromedp.Run(ctx, collectResults(), enableNetwork(), chromedp.Navigate(u))
 	if err != nil {
 		switch {
 		case errors.Is(err, syscall.ECONNREFUSED),
@@ -469,17 +971,9 @@ func runtest(ctx context.Context, cdp string, test Test, addr Address) (*TestRes
 	// tight poll steals CPU from the very test we're waiting on — across a whole
 	// pool of runners that self-inflicted load is what pushes borderline tests
 	// past noProgressGrace. One probe per period is plenty; tests take seconds.
-	const pollInterval = 2 * time.Second
-	noProgressGrace := 5 * time.Second
-	if strings.Contains(test.URL, "/wasm/") {
-		// /wasm/ tests can be slow on the CI, but are known to be pass
-		noProgressGrace = 10 * time.Second
-	}
-	if strings.Contains(test.URL, "/WebCryptoAPI/") {
-		// A single 100k-iteration PBKDF2 subtest can exceed the default grace
-		// on the CI; the file as a whole still finishes within its timeout.
-		noProgressGrace = 15 * time.Second
-	}
+	pollInterval := time.Duration(tm.ProbeInterval)
+	// The grace is longer for the slow suites, see TimeoutConfig.
+	noProgressGrace := time.Duration(tm.Grace)
 
 	var lastFP string
 	var forcedTimeout bool
@@ -529,8 +1023,9 @@ WAIT:
 			continue
 		}
 
-		// We don't want to probe more than once every 2 seconds (unecessary load on
-		// the server). Let's wait 2 seconds - (time elapsed this iteration so far)
+		// We don't want to probe more than once every pollInterval (unecessary load
+		// on the server). Let's wait pollInterval - (time elapsed this iteration so
+		// far)
 		if d := pollInterval - time.Since(iterStart); d > 0 {
 			select {
 			case <-ctx.Done():
@@ -570,40 +1065,159 @@ WAIT:
 		return res, nil
 	}
 
-	// parse the log
+	// Prefer the structured results, fallback on the log if they weren't
+	// collected.
+	var results string
+	rctx, rcancel = context.WithTimeout(ctx, probeTimeout)
+	err = chromedp.Run(rctx, chromedp.Evaluate(harnessResultsJS, &results))
+	rcancel()
+	if err != nil && isConnError(err) {
+		return nil, fmt.Errorf("%s: eval: %w", test.URL, err)
+	}
+
+	var cases []TestCase
+	if err == nil && results != "" {
+		cases, err = parseResults(results)
+	}
+	if err != nil || results == "" {
+		slog.Debug("structured results", slog.String("test", test.URL), slog.Any("err", err))
+		cases = parseLog(report)
+	}
+
 	res.Pass = true
+	for _, c := range cases {
+		if !c.Pass {
+			res.Pass = false
+		}
+	}
+	res.Cases = cases
+
+	return res, nil
+}
+
+// collectResultsJS registers testharness callbacks collecting the subtests
+// results in __wptrunnerResults, whatever the testharnessreport.js served.
+// testharness.js keeps its tests private and exposes its API by assigning it
+// to window, so the callbacks are registered from setters as soon as the API
+// is defined, before the test runs.
+const collectResultsJS = `(function() {
+	if (window !== window.top) return;
+
+	const collected = window.__wptrunnerResults = {results: [], complete: false};
+
+	function format(test) {
+		return {
+			name: String(test.name),
+			status: test.status,
+			message: test.message == null ? "" : String(test.message),
+			stack: test.stack == null ? "" : String(test.stack),
+		};
+	}
+
+	function hook(name, callback) {
+		Object.defineProperty(window, name, {
+			configurable: true,
+			get: function() { return undefined; },
+			set: function(fn) {
+				Object.defineProperty(window, name, {
+					configurable: true,
+					enumerable: true,
+					writable: true,
+					value: fn,
+				});
+				fn(callback);
+			},
+		});
+	}
+
+	hook("add_result_callback", function(test) {
+		if (!collected.complete) collected.results.push(format(test));
+	});
+	// The completion lists all the tests in their declaration order.
+	hook("add_completion_callback", function(tests) {
+		collected.results = Array.from(tests, format);
+		collected.complete = true;
+	});
+})();`
+
+// collectResults injects collectResultsJS in the documents to come.
+func collectResults() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		_, err := page.AddScriptToEvaluateOnNewDocument(collectResultsJS).Do(ctx)
+		return err
+	})
+}
+
+// harnessResultsJS returns the subtests results collected by
+// collectResultsJS as JSON, or an empty string if unavailable.
+const harnessResultsJS = `(function() {
+	if (typeof __wptrunnerResults === "undefined" || __wptrunnerResults.results.length === 0) return "";
+	return JSON.stringify(__wptrunnerResults.results);
+})()`
+
+// parseResults decodes the subtests results returned by harnessResultsJS.
+func parseResults(data string) ([]TestCase, error) {
+	var results []struct {
+		Name    string `json:"name"`
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+		Stack   string `json:"stack"`
+	}
+	if err := json.Unmarshal([]byte(data), &results); err != nil {
+		return nil, fmt.Errorf("decode results: %w", err)
+	}
+
+	cases := make([]TestCase, 0, len(results))
+	for _, r := range results {
+		if r.Status < 0 || r.Status >= len(harnessStatus) {
+			return nil, fmt.Errorf("invalid status %d for %q", r.Status, r.Name)
+		}
+		status := harnessStatus[r.Status]
+
+		// Names and messages are on a single line, as in the log.
+		cases = append(cases, TestCase{
+			Pass:    status == StatusPass,
+			Name:    strings.TrimSpace(strings.ReplaceAll(r.Name, "\n", " ")),
+			Status:  status,
+			Message: strings.TrimSpace(strings.ReplaceAll(r.Message, "\n", " ")),
+			Stack:   strings.TrimSpace(r.Stack),
+		})
+	}
+
+	return cases, nil
+}
+
+// parseLog parses the report log lines: name|Status message.
+func parseLog(report string) []TestCase {
+	var cases []TestCase
+
 	lines := strings.Split(strings.TrimSpace(report), "\n")
 NEXT:
 	for _, l := range lines {
-
-		for i, status := range []string{"|Pass", "|Fail", "|Timeout", "|Not Run", "|Optional Feature Unsupported"} {
-			name, msg, ok := strings.Cut(l, status)
+		for _, status := range harnessStatus {
+			name, msg, ok := strings.Cut(l, "|"+string(status))
 			if !ok {
 				continue
 			}
 
-			pass := i == 0
-			if !pass {
-				res.Pass = false
-			}
-
-			res.Cases = append(res.Cases, TestCase{
-				Pass:    pass,
+			cases = append(cases, TestCase{
+				Pass:    status == StatusPass,
 				Name:    strings.TrimSpace(name),
+				Status:  status,
 				Message: strings.TrimSpace(msg),
 			})
 			continue NEXT
 		}
 
-		res.Cases = append(res.Cases, TestCase{
+		cases = append(cases, TestCase{
 			Pass:    false,
 			Name:    "Invalid report format",
+			Status:  StatusFail,
 			Message: l,
 		})
-
 	}
 
-	return res, nil
+	return cases
 }
 
 // env returns the env value corresponding to the key or the default string.
@@ -616,8 +1230,57 @@ func env(key, dflt string) string {
 	return val
 }
 
+// RunOptions configures how the tests are run.
+type RunOptions struct {
+	Addr Address
+	// Profile enables the sampling of the browser's resources usage.
+	Profile bool
+	// Testdriver enables the testdriver actions for the tests using it.
+	Testdriver bool
+	// Timeouts are the tests timeouts, nil for the built-in ones.
+	Timeouts *TimeoutConfig
+	// Isolate runs each test in its own browser context.
+	Isolate bool
+	// LeakCheck reports the state left by the previous tests.
+	LeakCheck bool
+}
+
 type Address struct {
 	http  string
 	https string
 	http2 string
 }
+
+// URL returns the full URL of a path, using the server matching the scheme
+// from the test metadata.
+func (a Address) URL(path, scheme string) string {
+	base := a.http
+	switch scheme {
+	case "https":
+		base = a.https
+	case "h2":
+		base = a.http2
+	}
+	return base + path
+}
+
+// Origins returns the origins of the test servers.
+func (a Address) Origins() []string {
+	var origins []string
+	for _, base := range []string{a.http, a.https, a.http2} {
+		u, err := url.Parse(base)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		origins = append(origins, u.Scheme+"://"+u.Host)
+	}
+	return origins
+}
+
+// isConnError returns true if the error is caused by a lost connection with
+// the browser.
+func isConnError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	// pageLogMax is the max number of entries kept in a page log.
+	pageLogMax = 50
+	// pageLogLine is the max length of an entry text.
+	pageLogLine = 500
+)
+
+// LogEntry is a console message, an uncaught exception or a failed request
+// of the test page.
+type LogEntry struct {
+	// Kind is console, exception or network.
+	Kind string `json:"kind"`
+	// Level is the console call type.
+	Level string `json:"level,omitempty"`
+	Text  string `json:"text"`
+}
+
+// String returns the entry on one line.
+func (e LogEntry) String() string {
+	if e.Level != "" {
+		return fmt.Sprintf("[%s.%s] %s", e.Kind, e.Level, e.Text)
+	}
+	return fmt.Sprintf("[%s] %s", e.Kind, e.Text)
+}
+
+// pageLog collects the log entries of a page, up to pageLogMax.
+type pageLog struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	dropped int
+	// urls are the requests URL by id, to report the failed ones.
+	urls map[network.RequestID]string
+}
+
+// capturePageLog listens to the console, exceptions and network events of
+// the context. The failed requests are reported once enableNetwork ran.
+func capturePageLog(ctx context.Context) *pageLog {
+	l := &pageLog{urls: make(map[network.RequestID]string)}
+
+	chromedp.ListenTarget(ctx, func(ev any) {
+		switch e := ev.(type) {
+		case *runtime.EventConsoleAPICalled:
+			args := make([]string, 0, len(e.Args))
+			for _, a := range e.Args {
+				args = append(args, remoteString(a))
+			}
+			l.add(LogEntry{Kind: "console", Level: string(e.Type), Text: strings.Join(args, " ")})
+
+		case *runtime.EventExceptionThrown:
+			d := e.ExceptionDetails
+			if d == nil {
+				return
+			}
+			text := d.Text
+			if d.Exception != nil && d.Exception.Description != "" {
+				text += " " + d.Exception.Description
+			}
+			if d.URL != "" {
+				text += fmt.Sprintf(" (%s:%d:%d)", d.URL, d.LineNumber+1, d.ColumnNumber+1)
+			}
+			l.add(LogEntry{Kind: "exception", Text: text})
+
+		case *network.EventRequestWillBeSent:
+			if e.Request == nil {
+				return
+			}
+			l.mu.Lock()
+			l.urls[e.RequestID] = e.Request.URL
+			l.mu.Unlock()
+
+		case *network.EventLoadingFailed:
+			l.mu.Lock()
+			u := l.urls[e.RequestID]
+			l.mu.Unlock()
+
+			text := fmt.Sprintf("%s %s", u, e.ErrorText)
+			if e.BlockedReason != "" {
+				text += " blocked: " + string(e.BlockedReason)
+			}
+			l.add(LogEntry{Kind: "network", Text: strings.TrimSpace(text)})
+		}
+	})
+
+	return l
+}
+
+// enableNetwork enables the network events. Errors are ignored, the log
+// is a best effort.
+func enableNetwork() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		network.Enable().Do(ctx)
+		return nil
+	})
+}
+
+func (l *pageLog) add(e LogEntry) {
+	if r := []rune(e.Text); len(r) > pageLogLine {
+		e.Text = string(r[:pageLogLine]) + "…"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) >= pageLogMax {
+		l.dropped++
+		return
+	}
+	l.entries = append(l.entries, e)
+}
+
+// Entries returns the collected entries. A last entry counts the dropped
+// ones.
+func (l *pageLog) Entries() []LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := append([]LogEntry(nil), l.entries...)
+	if l.dropped > 0 {
+		entries = append(entries, LogEntry{
+			Kind: "log",
+			Text: fmt.Sprintf("%d entries dropped", l.dropped),
+		})
+	}
+	return entries
+}
+
+// remoteString returns a readable value of a console argument.
+func remoteString(o *runtime.RemoteObject) string {
+	if o == nil {
+		return ""
+	}
+	if len(o.Value) > 0 {
+		var s string
+		if err := json.Unmarshal(o.Value, &s); err == nil {
+			return s
+		}
+		return string(o.Value)
+	}
+	if o.UnserializableValue != "" {
+		return string(o.UnserializableValue)
+	}
+	if o.Description != "" {
+		return o.Description
+	}
+	return string(o.Type)
+}
@@ -6,6 +6,7 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // memUsage returns the resident memory usage in bytes of the process
@@ -36,3 +37,99 @@ func memUsage(cmd *exec.Cmd) (uint64, error) {
 	pageSize := uint64(os.Getpagesize())
 	return rssPages * pageSize, nil
 }
+
+// clockTicks is the kernel USER_HZ, used by /proc/<pid>/stat times. It's 100
+// on all the common linux platforms.
+const clockTicks = 100
+
+// cpuUsage returns the CPU time (user + system) consumed by the process
+// behind a running exec.Cmd by reading /proc/<pid>/stat.
+func cpuUsage(cmd *exec.Cmd) (time.Duration, error) {
+	if cmd.Process == nil {
+		return 0, fmt.Errorf("process not started")
+	}
+
+	pid := cmd.Process.Pid
+
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, fmt.Errorf("read stat: %w", err)
+	}
+
+	// The command name (2nd field) can contain spaces, so we skip it by
+	// cutting after its closing parenthesis. The remaining fields start at
+	// the 3rd one (state), utime and stime are the 14th and 15th.
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("unexpected stat format")
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("unexpected stat format")
+	}
+
+	var ticks uint64
+	for _, f := range fields[11:13] {
+		n, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse cpu time: %w", err)
+		}
+		ticks += n
+	}
+
+	return time.Duration(ticks) * time.Second / clockTicks, nil
+}
+
+// profileInterval is the delay between two samples of the browser's
+// resources usage.
+const profileInterval = 100 * time.Millisecond
+
+// profile samples the resources usage of the process until the returned stop
+// function is called. stop returns the resident memory at the start and its
+// peak in bytes, and the CPU time consumed meanwhile.
+// The usage is the process' one: with concurrent tests running on the same
+// browser, it's shared between all of them.
+func profile(cmd *exec.Cmd) (stop func() (rss0, maxrss uint64, cpu time.Duration)) {
+	cpu0, _ := cpuUsage(cmd)
+	rss0, _ := memUsage(cmd)
+	maxrss := rss0
+
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+
+		ticker := time.NewTicker(profileInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				rss, err := memUsage(cmd)
+				if err != nil {
+					// the process is gone.
+					return
+				}
+				maxrss = max(maxrss, rss)
+			}
+		}
+	}()
+
+	return func() (uint64, uint64, time.Duration) {
+		close(done)
+		<-sampled
+
+		rss, err := memUsage(cmd)
+		if err == nil {
+			maxrss = max(maxrss, rss)
+		}
+
+		cpu1, err := cpuUsage(cmd)
+		if err != nil || cpu1 < cpu0 {
+			return rss0, maxrss, 0
+		}
+		return rss0, maxrss, cpu1 - cpu0
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	// progressInterval is the refresh delay of the status line.
+	progressInterval = 500 * time.Millisecond
+	// progressSlowest is the number of slowest in-flight tests displayed.
+	progressSlowest = 3
+)
+
+// Progress displays a status line of the run on a terminal, refreshed
+// periodically. A nil Progress does nothing.
+type Progress struct {
+	// Total is the number of tests to run.
+	Total int
+	// Restarts returns the number of browser restarts.
+	Restarts func() int
+
+	mu    sync.Mutex
+	f     *os.File
+	start time.Time
+	// shown is set when the status line is displayed.
+	shown bool
+
+	done, pass, fail, crash, oom int
+	// inflight are the running tests by run id, the same test can run
+	// several times concurrently with --repeat.
+	inflight map[int]running
+	runs     int
+}
+
+// running is a test in progress.
+type running struct {
+	test  string
+	start time.Time
+}
+
+// NewProgress returns a progress writing the status line on f. It returns
+// nil if f is not a terminal: the refreshes would fill the logs.
+func NewProgress(f *os.File, total int, restarts func() int) *Progress {
+	if !term.IsTerminal(int(f.Fd())) {
+		return nil
+	}
+
+	return &Progress{
+		Total:    total,
+		Restarts: restarts,
+		f:        f,
+		start:    time.Now(),
+		inflight: make(map[int]running),
+	}
+}
+
+// Start records a test running. The returned func must be called when the
+// test is over.
+func (p *Progress) Start(test string) (end func()) {
+	if p == nil {
+		return func() {}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.runs++
+	id := p.runs
+	p.inflight[id] = running{test: test, start: time.Now()}
+
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		delete(p.inflight, id)
+	}
+}
+
+// Done records the result of a test.
+func (p *Progress) Done(res *TestResult) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done++
+	switch {
+	case res.OOM:
+		p.oom++
+	case res.Crash:
+		p.crash++
+	case res.Pass:
+		p.pass++
+	default:
+		p.fail++
+	}
+}
+
+// Print calls fn with the status line cleared, so fn can write on the same
+// terminal. The status line is displayed again at the next refresh.
+func (p *Progress) Print(fn func()) {
+	if p == nil {
+		fn()
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+	fn()
+}
+
+// Writer returns a writer clearing the status line before each write, so
+// the logs don't interleave with it.
+func (p *Progress) Writer() io.Writer {
+	return progressWriter{p}
+}
+
+type progressWriter struct {
+	p *Progress
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	w.p.mu.Lock()
+	defer w.p.mu.Unlock()
+
+	w.p.clear()
+	return w.p.f.Write(b)
+}
+
+// Run refreshes the status line until the context is done.
+func (p *Progress) Run(ctx context.Context) {
+	if p == nil {
+		return
+	}
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			p.clear()
+			fmt.Fprint(p.f, p.line(time.Now()))
+			p.shown = true
+			p.mu.Unlock()
+		}
+	}
+}
+
+// Stop writes the final status line.
+func (p *Progress) Stop() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+	fmt.Fprintln(p.f, p.line(time.Now()))
+}
+
+// clear erases the status line. Must be called with the lock.
+func (p *Progress) clear() {
+	if p.shown {
+		fmt.Fprint(p.f, "\r\033[K")
+		p.shown = false
+	}
+}
+
+// line returns the status line. Must be called with the lock.
+func (p *Progress) line(now time.Time) string {
+	elapsed := now.Sub(p.start)
+
+	var (
+		rate float64
+		eta  = "-"
+	)
+	if elapsed > 0 {
+		rate = float64(p.done) / elapsed.Seconds()
+	}
+	if rate > 0 && p.Total >= p.done {
+		remaining := time.Duration(float64(p.Total-p.done) / rate * float64(time.Second))
+		eta = remaining.Round(time.Second).String()
+	}
+
+	var restarts int
+	if p.Restarts != nil {
+		restarts = p.Restarts()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d/%d P %d F %d C %d O %d | %.1f t/s | ETA %s | restarts %d",
+		p.done, p.Total, p.pass, p.fail, p.crash, p.oom, rate, eta, restarts,
+	)
+
+	if slow := p.slowest(now); len(slow) > 0 {
+		fmt.Fprintf(&b, " | slow: %s", strings.Join(slow, ", "))
+	}
+
+	// A wrapped line can't be cleared, keep it on a single row.
+	line := []rune(b.String())
+	if width, _, err := term.GetSize(int(p.f.Fd())); err == nil && width > 1 && len(line) >= width {
+		line = append(line[:width-2], '…')
+	}
+
+	return string(line)
+}
+
+// slowest returns the longest running tests with their duration. Must be
+// called with the lock.
+func (p *Progress) slowest(now time.Time) []string {
+	tests := make([]running, 0, len(p.inflight))
+	for _, t := range p.inflight {
+		tests = append(tests, t)
+	}
+	sort.Slice(tests, func(i, j int) bool {
+		return tests[i].start.Before(tests[j].start)
+	})
+
+	var slow []string
+	for _, t := range tests[:min(progressSlowest, len(tests))] {
+		slow = append(slow, fmt.Sprintf("%s (%s)", t.test, now.Sub(t.start).Round(time.Second)))
+	}
+	return slow
+}
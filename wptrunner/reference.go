@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// resolveCDP returns the websocket debugger URL of a CDP endpoint.
+// Chrome doesn't accept connections on the base ws URL, so the browser URL is
+// requested from /json/version. The address is returned unchanged if the
+// endpoint doesn't answer.
+func resolveCDP(ctx context.Context, addr string) string {
+	if strings.Contains(addr, "/devtools/") {
+		return addr
+	}
+
+	base := strings.Replace(addr, "ws://", "http://", 1)
+	base = strings.Replace(base, "wss://", "https://", 1)
+
+	v, err := cdpVersion(ctx, strings.TrimSuffix(base, "/"))
+	if err != nil || v.WebSocketDebuggerURL == "" {
+		slog.Debug("cdp version", slog.String("addr", addr), slog.Any("err", err))
+		return addr
+	}
+
+	return v.WebSocketDebuggerURL
+}
+
+// runReference runs the test on the reference browser.
+func runReference(ctx context.Context, cdp string, t Test, opts RunOptions) *TestResult {
+	// No process is managed for the reference browser.
+	opts.Profile = false
+	// The leaks are checked on the main browser.
+	opts.LeakCheck = false
+
+	res := exectest(ctx, &Lease{CDP: cdp}, t, opts)
+	// The metadata is already in the main result.
+	res.Meta = nil
+
+	return res
+}
+
+// writeReference writes the tests failing while passing on the reference
+// browser.
+func writeReference(w io.Writer, behind []*TestResult) {
+	fmt.Fprintf(w, "\nFailing, but passing on the reference: %d\n", len(behind))
+	for _, res := range behind {
+		fmt.Fprintf(w, "\t%s %d/%d\t%d/%d\t%q\n",
+			res.Outcome(), res.CountOK(), res.Total(),
+			res.Reference.CountOK(), res.Reference.Total(),
+			res.Name,
+		)
+	}
+}
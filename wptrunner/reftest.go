@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	// crashtestGrace is the time a crashtest page is given after its load
+	// to crash the browser.
+	crashtestGrace = time.Second
+
+	// waitClassInterval is the delay between two checks of the test-wait and
+	// reftest-wait classes.
+	waitClassInterval = 100 * time.Millisecond
+)
+
+// waitClass blocks until the root element doesn't have the class anymore,
+// the context is done or the page stops answering.
+func waitClass(ctx context.Context, class string) error {
+	for {
+		var waiting bool
+		err := chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf(
+			`document.documentElement.classList.contains(%q)`, class,
+		), &waiting))
+		if err != nil || !waiting {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(waitClassInterval):
+		}
+	}
+}
+
+// runcrashtest loads the crashtest page and checks the browser survives it.
+func runcrashtest(ctx context.Context, cdp string, test Test, opts RunOptions) (*TestResult, error) {
+	u := opts.Addr.URL(test.URL, test.Meta.Scheme())
+	slog.Debug("run crashtest", slog.String("test", test.URL), slog.String("cdp", cdp), slog.String("url", u))
+
+	res := &TestResult{Name: test.URL}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeouts.For(test).Total(test.Long))
+	defer cancel()
+
+	ctx, cancel, done, err := openTest(ctx, cdp, test, opts, res)
+	if done != nil || err != nil {
+		return done, err
+	}
+	defer cancel()
+
+	start := time.Now()
+	err = chromedp.Run(ctx, chromedp.Navigate(u))
+	if err == nil {
+		// The test can delay its end with the test-wait class.
+		err = waitClass(ctx, "test-wait")
+	}
+	if err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(crashtestGrace):
+		}
+	}
+	if err == nil {
+		// The browser must still answer.
+		var state string
+		err = chromedp.Run(ctx, chromedp.Evaluate(`document.readyState`, &state))
+	}
+	res.Elapsed = time.Since(start)
+
+	if err != nil {
+		if isConnError(err) {
+			return nil, fmt.Errorf("%s: crashtest: %w", test.URL, err)
+		}
+		res.Message = strings.TrimSpace(err.Error())
+		return res, nil
+	}
+
+	res.Pass = true
+	return res, nil
+}
+
+// serializeJS returns the layout relevant state of the page, one line per
+// rendered box: the element boxes with their computed styles and geometry,
+// the text runs and the replaced elements sources. The tags aren't
+// serialized: a test and its reference often use different markups for the
+// same rendering.
+// The elements not rendered (display: none) are skipped.
+const serializeJS = `(function(){
+	const props = [
+		"display", "position", "float", "clear", "box-sizing",
+		"top", "right", "bottom", "left", "z-index",
+		"width", "height", "min-width", "min-height", "max-width", "max-height",
+		"margin-top", "margin-right", "margin-bottom", "margin-left",
+		"padding-top", "padding-right", "padding-bottom", "padding-left",
+		"border-top-width", "border-right-width", "border-bottom-width", "border-left-width",
+		"border-top-style", "border-right-style", "border-bottom-style", "border-left-style",
+		"border-top-color", "border-right-color", "border-bottom-color", "border-left-color",
+		"border-radius", "outline-style", "outline-width", "outline-color",
+		"color", "background-color", "background-image", "background-position", "background-size", "background-repeat",
+		"font-family", "font-size", "font-style", "font-weight", "line-height", "letter-spacing", "word-spacing",
+		"text-align", "text-decoration-line", "text-transform", "text-indent", "white-space", "vertical-align",
+		"direction", "writing-mode", "overflow-x", "overflow-y",
+		"opacity", "visibility", "transform", "filter", "clip-path", "list-style-type",
+		"flex-direction", "flex-wrap", "justify-content", "align-items", "align-content", "order",
+		"grid-template-columns", "grid-template-rows",
+	];
+	const replaced = {IMG: "src", IFRAME: "src", EMBED: "src", OBJECT: "data", VIDEO: "poster", INPUT: "value"};
+	const out = [];
+	const walk = function(node, depth) {
+		const indent = " ".repeat(depth);
+		if (node.nodeType === Node.TEXT_NODE) {
+			const text = node.data.replace(/\s+/g, " ").trim();
+			if (text !== "") out.push(indent + "text " + JSON.stringify(text));
+			return;
+		}
+		if (node.nodeType !== Node.ELEMENT_NODE) return;
+
+		const style = getComputedStyle(node);
+		if (style.getPropertyValue("display") === "none") return;
+
+		const r = node.getBoundingClientRect();
+		const box = [Math.round(r.x), Math.round(r.y), Math.round(r.width), Math.round(r.height)].join(",");
+		const values = props.map(function(p) { return p + ":" + style.getPropertyValue(p); });
+		out.push(indent + "box " + box + " " + values.join(";"));
+
+		const attr = replaced[node.tagName];
+		if (attr) out.push(indent + " replaced " + node.tagName.toLowerCase() + " " + JSON.stringify(node.getAttribute(attr) || ""));
+		if (node.tagName === "CANVAS" && typeof node.toDataURL === "function") {
+			try { out.push(indent + " canvas " + node.toDataURL()); } catch (e) {}
+		}
+
+		for (const child of node.childNodes) walk(child, depth + 1);
+	};
+	walk(document.documentElement, 0);
+	return out;
+})()`
+
+// serialize loads the page and returns its serialization.
+func serialize(ctx context.Context, u string) ([]string, error) {
+	if err := chromedp.Run(ctx, chromedp.Navigate(u)); err != nil {
+		return nil, fmt.Errorf("navigate: %w", err)
+	}
+
+	if err := waitClass(ctx, "reftest-wait"); err != nil {
+		return nil, fmt.Errorf("reftest-wait: %w", err)
+	}
+
+	var out []string
+	if err := chromedp.Run(ctx, chromedp.Evaluate(serializeJS, &out)); err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	return out, nil
+}
+
+// firstDiff returns the index of the first differing line, -1 if equal.
+func firstDiff(got, want []string) int {
+	for i := 0; i < len(got) && i < len(want); i++ {
+		if got[i] != want[i] {
+			return i
+		}
+	}
+	if len(got) != len(want) {
+		return min(len(got), len(want))
+	}
+	return -1
+}
+
+// line returns the line i or a placeholder if missing.
+func line(lines []string, i int) string {
+	if i < len(lines) {
+		return strings.TrimSpace(lines[i])
+	}
+	return "<none>"
+}
+
+// runreftest compares the layout relevant state of the test page with its
+// references, see serializeJS. Each reference is reported as a test case.
+// Pixels are not compared: two pages with the same boxes, styles and texts
+// are considered rendering the same.
+func runreftest(ctx context.Context, cdp string, test Test, opts RunOptions) (*TestResult, error) {
+	u := opts.Addr.URL(test.URL, test.Meta.Scheme())
+	slog.Debug("run reftest", slog.String("test", test.URL), slog.String("cdp", cdp), slog.String("url", u))
+
+	res := &TestResult{Name: test.URL}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeouts.For(test).Total(test.Long))
+	defer cancel()
+
+	ctx, cancel, done, err := openTest(ctx, cdp, test, opts, res)
+	if done != nil || err != nil {
+		return done, err
+	}
+	defer cancel()
+
+	start := time.Now()
+	defer func() {
+		res.Elapsed = time.Since(start)
+	}()
+
+	got, err := serialize(ctx, u)
+	if err != nil {
+		if isConnError(err) {
+			return nil, fmt.Errorf("%s: reftest: %w", test.URL, err)
+		}
+		res.Message = strings.TrimSpace(err.Error())
+		return res, nil
+	}
+
+	res.Pass = true
+	for _, ref := range test.Refs {
+		tc := TestCase{Name: ref.Relation + " " + ref.URL}
+
+		want, err := serialize(ctx, opts.Addr.URL(ref.URL, test.Meta.Scheme()))
+		switch {
+		case err != nil && isConnError(err):
+			return nil, fmt.Errorf("%s: reference %s: %w", test.URL, ref.URL, err)
+		case err != nil:
+			tc.Message = strings.TrimSpace(err.Error())
+		case ref.Relation == "!=":
+			tc.Pass = firstDiff(got, want) >= 0
+			if !tc.Pass {
+				tc.Message = "test and reference match"
+			}
+		default:
+			if i := firstDiff(got, want); i >= 0 {
+				tc.Message = fmt.Sprintf("line %d: got %q, want %q", i+1, truncate(line(got, i)), truncate(line(want, i)))
+			} else {
+				tc.Pass = true
+			}
+		}
+
+		tc.Status = StatusPass
+		if !tc.Pass {
+			tc.Status = StatusFail
+			res.Pass = false
+		}
+		res.Cases = append(res.Cases, tc)
+	}
+
+	return res, nil
+}
+
+// truncate shortens s for messages.
+func truncate(s string) string {
+	const n = 200
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "…"
+	}
+	return s
+}
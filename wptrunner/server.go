@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// testharnessReportJS replaces the testharnessreport.js of the WPT checkout.
+// It exposes the report object polled by runtest.
+const testharnessReportJS = `var report = {complete: false, completed: 0, status: "", log: ""};
+
+add_result_callback(function(test) {
+	report.completed++;
+	var msg = test.message ? " " + String(test.message).replace(/\n/g, " ") : "";
+	report.log += test.name.replace(/\n/g, " ") + "|" + test.format_status() + msg + "\n";
+});
+
+add_completion_callback(function(tests, harness_status) {
+	report.status = harness_status.format_status();
+	report.complete = true;
+});
+`
+
+// Server serves a WPT checkout without the python wpt serve: it generates the
+// tests wrappers for the .any.js, .window.js and .worker.js files and the
+// manifest of the tests it supports. The manifest of the checkout, if any,
+// is ignored: it lists the https and python handlers tests too.
+// Tests requiring python handlers or https aren't supported.
+type Server struct {
+	Root string
+
+	srv *http.Server
+}
+
+// Start listens on the address and serves the checkout in background.
+// It returns the base URL of the server.
+func (s *Server) Start(addr string) (string, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", fmt.Errorf("listen: %w", err)
+	}
+
+	s.srv = &http.Server{Handler: s}
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("wpt server", slog.Any("err", err))
+		}
+	}()
+
+	return "http://" + ln.Addr().String(), nil
+}
+
+// Stop stops the server.
+func (s *Server) Stop(ctx context.Context) error {
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := path.Clean(r.URL.Path)
+
+	switch {
+	case p == "/resources/testharnessreport.js":
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		fmt.Fprint(w, testharnessReportJS)
+		return
+
+	case p == "/MANIFEST.json":
+		s.serveManifest(w)
+		return
+
+	case s.exists(p):
+		http.ServeFile(w, r, s.file(p))
+		return
+	}
+
+	// generated wrappers
+	var (
+		body  string
+		ctype = "text/html; charset=utf-8"
+	)
+	switch {
+	case strings.HasSuffix(p, ".any.html") && s.exists(strings.TrimSuffix(p, ".html")+".js"):
+		src := strings.TrimSuffix(p, ".html") + ".js"
+		body = s.windowWrapper(src, true)
+	case strings.HasSuffix(p, ".any.worker.html") && s.exists(strings.TrimSuffix(p, ".worker.html")+".js"):
+		body = workerWrapper(path.Base(strings.TrimSuffix(p, ".html") + ".js"))
+	case strings.HasSuffix(p, ".any.worker.js") && s.exists(strings.TrimSuffix(p, ".worker.js")+".js"):
+		src := strings.TrimSuffix(p, ".worker.js") + ".js"
+		body = s.workerScript(src)
+		ctype = "text/javascript; charset=utf-8"
+	case strings.HasSuffix(p, ".window.html") && s.exists(strings.TrimSuffix(p, ".html")+".js"):
+		src := strings.TrimSuffix(p, ".html") + ".js"
+		body = s.windowWrapper(src, false)
+	case strings.HasSuffix(p, ".worker.html") && s.exists(strings.TrimSuffix(p, ".html")+".js"):
+		body = workerWrapper(path.Base(strings.TrimSuffix(p, ".html") + ".js"))
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", ctype)
+	fmt.Fprint(w, body)
+}
+
+// file returns the local file path of an URL path.
+func (s *Server) file(p string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(p))
+}
+
+// exists returns true if the URL path matches a regular file.
+func (s *Server) exists(p string) bool {
+	fi, err := os.Stat(s.file(p))
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// windowWrapper returns the HTML page running a .any.js or .window.js test
+// in a window.
+func (s *Server) windowWrapper(src string, any bool) string {
+	meta, _ := readMeta(s.file(src))
+
+	var b strings.Builder
+	b.WriteString("<!doctype html>\n<meta charset=utf-8>\n")
+	for _, m := range meta {
+		if m[0] == "title" {
+			fmt.Fprintf(&b, "<title>%s</title>\n", html.EscapeString(m[1]))
+		}
+	}
+	if any {
+		b.WriteString("<script>self.GLOBAL = {isWindow: function() { return true; }, isWorker: function() { return false; }, isShadowRealm: function() { return false; }};</script>\n")
+	}
+	b.WriteString("<script src=\"/resources/testharness.js\"></script>\n")
+	b.WriteString("<script src=\"/resources/testharnessreport.js\"></script>\n")
+	for _, m := range meta {
+		if m[0] == "script" {
+			fmt.Fprintf(&b, "<script src=\"%s\"></script>\n", html.EscapeString(m[1]))
+		}
+	}
+	b.WriteString("<div id=log></div>\n")
+	fmt.Fprintf(&b, "<script src=\"%s\"></script>\n", html.EscapeString(path.Base(src)))
+
+	return b.String()
+}
+
+// workerWrapper returns the HTML page running the worker test script.
+func workerWrapper(script string) string {
+	return fmt.Sprintf(`<!doctype html>
+<meta charset=utf-8>
+<script src="/resources/testharness.js"></script>
+<script src="/resources/testharnessreport.js"></script>
+<div id=log></div>
+<script>fetch_tests_from_worker(new Worker(%q));</script>
+`, script)
+}
+
+// workerScript returns the worker script running a .any.js test.
+func (s *Server) workerScript(src string) string {
+	meta, _ := readMeta(s.file(src))
+
+	var b strings.Builder
+	b.WriteString("importScripts(\"/resources/testharness.js\");\n")
+	b.WriteString("self.GLOBAL = {isWindow: function() { return false; }, isWorker: function() { return true; }, isShadowRealm: function() { return false; }};\n")
+	for _, m := range meta {
+		if m[0] == "script" {
+			fmt.Fprintf(&b, "importScripts(%q);\n", m[1])
+		}
+	}
+	fmt.Fprintf(&b, "importScripts(%q);\n", path.Base(src))
+	b.WriteString("done();\n")
+
+	return b.String()
+}
+
+// readMeta reads the "// META: key=value" comments at the top of a test
+// script.
+func readMeta(name string) ([][2]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var meta [][2]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "//") {
+			break
+		}
+
+		kv, ok := strings.CutPrefix(line, "// META:")
+		if !ok {
+			continue
+		}
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		meta = append(meta, [2]string{strings.TrimSpace(k), strings.TrimSpace(v)})
+	}
+
+	return meta, scanner.Err()
+}
+
+// serveManifest generates a manifest with the testharness tests supported by
+// the server.
+func (s *Server) serveManifest(w http.ResponseWriter) {
+	items, err := s.scan()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"version":  8,
+		"url_base": "/",
+		"items": map[string]any{
+			TypeTestharness: items,
+		},
+	})
+}
+
+// skipDir returns true if the directory doesn't contain tests.
+func skipDir(name string) bool {
+	switch name {
+	case "resources", "support", "tools", "common":
+		return true
+	}
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// scan walks the checkout and returns the testharness items tree, in the
+// manifest format.
+func (s *Server) scan() (map[string]any, error) {
+	root := make(map[string]any)
+
+	add := func(rel string, variants []any) {
+		dirs := strings.Split(rel, "/")
+		node := root
+		for _, d := range dirs[:len(dirs)-1] {
+			sub, ok := node[d].(map[string]any)
+			if !ok {
+				sub = make(map[string]any)
+				node[d] = sub
+			}
+			node = sub
+		}
+		node[dirs[len(dirs)-1]] = append([]any{""}, variants...)
+	}
+
+	var skipped int
+	err := filepath.WalkDir(s.Root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != s.Root && skipDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.Root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		flags := fileFlags(rel)
+		if slices.Contains(flags, "https") || slices.Contains(flags, "h2") {
+			// only http is served.
+			skipped++
+			return nil
+		}
+
+		name := d.Name()
+		switch {
+		case strings.HasSuffix(name, ".any.js"):
+			meta, err := readMeta(p)
+			if err != nil {
+				return err
+			}
+			base := strings.TrimSuffix(rel, ".js")
+			var urls []string
+			for _, g := range anyGlobals(meta) {
+				switch g {
+				case "window":
+					urls = append(urls, base+".html")
+				case "dedicatedworker":
+					urls = append(urls, base+".worker.html")
+				}
+			}
+			add(rel, variants(urls, meta))
+
+		case strings.HasSuffix(name, ".window.js"), strings.HasSuffix(name, ".worker.js"):
+			meta, err := readMeta(p)
+			if err != nil {
+				return err
+			}
+			add(rel, variants([]string{strings.TrimSuffix(rel, ".js") + ".html"}, meta))
+
+		case strings.HasSuffix(name, ".html"), strings.HasSuffix(name, ".htm"):
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			if !strings.Contains(string(data), "/resources/testharness.js") {
+				return nil
+			}
+			add(rel, []any{[]any{nil, map[string]any{}}})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+
+	if skipped > 0 {
+		slog.Info("wpt server: skipped https tests", slog.Int("count", skipped))
+	}
+
+	return root, nil
+}
+
+// anyGlobals returns the scopes of a .any.js test from its META global.
+func anyGlobals(meta [][2]string) []string {
+	for _, m := range meta {
+		if m[0] == "global" {
+			var globals []string
+			for g := range strings.SplitSeq(m[1], ",") {
+				g = strings.TrimSpace(g)
+				switch g {
+				case "worker":
+					g = "dedicatedworker"
+				case "window-module", "dedicatedworker-module":
+					// modules are not supported
+					continue
+				}
+				globals = append(globals, g)
+			}
+			return globals
+		}
+	}
+	return []string{"window", "dedicatedworker"}
+}
+
+// variants returns the manifest variants of the urls, multiplied by the META
+// variants.
+func variants(urls []string, meta [][2]string) []any {
+	opts := map[string]any{}
+	var (
+		queries []string
+		scripts [][2]string
+	)
+	for _, m := range meta {
+		switch m[0] {
+		case "timeout":
+			opts["timeout"] = m[1]
+		case "variant":
+			queries = append(queries, m[1])
+		case "script", "title":
+			scripts = append(scripts, m)
+		}
+	}
+	if len(scripts) > 0 {
+		opts["script_metadata"] = scripts
+	}
+	if len(queries) == 0 {
+		queries = []string{""}
+	}
+
+	var out []any
+	for _, u := range urls {
+		for _, q := range queries {
+			out = append(out, []any{u + q, opts})
+		}
+	}
+	return out
+}
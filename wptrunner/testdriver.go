@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/cdproto/input"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+)
+
+// testdriverBinding is the runtime binding used by the page to send the
+// testdriver actions to the runner.
+const testdriverBinding = "__wptrunnerTestdriver"
+
+// testdriverVendorJS plays the role of testdriver-vendor.js: it's injected
+// in each document and implements test_driver_internal by posting the
+// actions to the runner. The runner resolves the action's promise once
+// executed with __wptrunnerResolve.
+const testdriverVendorJS = `(function() {
+	const pending = new Map();
+	let nextID = 0;
+
+	window.__wptrunnerResolve = function(id, error) {
+		const p = pending.get(id);
+		if (!p) return;
+		pending.delete(id);
+		if (error) {
+			p.reject(new Error(error));
+		} else {
+			p.resolve();
+		}
+	};
+
+	function send(action, params) {
+		return new Promise(function(resolve, reject) {
+			const id = ++nextID;
+			pending.set(id, {resolve, reject});
+			window.` + testdriverBinding + `(JSON.stringify(Object.assign({id, action}, params)));
+		});
+	}
+
+	function center(element) {
+		const r = element.getBoundingClientRect();
+		return {x: r.left + r.width / 2, y: r.top + r.height / 2};
+	}
+
+	// Elements can't be sent to the runner, so pointer origins are resolved
+	// into viewport coordinates.
+	function resolveOrigins(actions) {
+		return actions.map(function(source) {
+			return Object.assign({}, source, {
+				actions: (source.actions || []).map(function(a) {
+					if (a.origin instanceof Element) {
+						const c = center(a.origin);
+						return Object.assign({}, a, {origin: "viewport", x: c.x + (a.x || 0), y: c.y + (a.y || 0)});
+					}
+					return a;
+				}),
+			});
+		});
+	}
+
+	function patch(internal) {
+		internal.in_automation = true;
+		internal.click = function(element, coords) {
+			return send("click", coords || center(element));
+		};
+		internal.send_keys = function(element, keys) {
+			element.focus();
+			return send("send_keys", {keys});
+		};
+		internal.action_sequence = function(actions) {
+			return send("action_sequence", {actions: resolveOrigins(actions)});
+		};
+		internal.set_permission = function(permission_params, context) {
+			const {descriptor, state} = permission_params;
+			return send("set_permission", {descriptor, state, origin: location.origin});
+		};
+	}
+
+	// testdriver.js creates test_driver_internal, patch it on assignment.
+	let internal;
+	Object.defineProperty(window, "test_driver_internal", {
+		configurable: true,
+		get() { return internal; },
+		set(v) {
+			internal = v;
+			if (v) patch(v);
+		},
+	});
+})();`
+
+// tdAction is an action sent by testdriverVendorJS.
+type tdAction struct {
+	ID     int64  `json:"id"`
+	Action string `json:"action"`
+
+	// click
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+
+	// send_keys
+	Keys string `json:"keys"`
+
+	// action_sequence
+	Actions []tdSource `json:"actions"`
+
+	// set_permission
+	Descriptor *browser.PermissionDescriptor `json:"descriptor"`
+	State      browser.PermissionSetting     `json:"state"`
+	Origin     string                        `json:"origin"`
+}
+
+// tdSource is an input source of a WebDriver actions sequence.
+type tdSource struct {
+	Type    string    `json:"type"`
+	Actions []tdInput `json:"actions"`
+}
+
+// tdInput is an action of a WebDriver input source.
+type tdInput struct {
+	Type     string  `json:"type"`
+	Duration int64   `json:"duration"`
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Button   int     `json:"button"`
+	Value    string  `json:"value"`
+	// Origin of a pointer move: viewport or pointer, the elements are
+	// resolved to the viewport by testdriverVendorJS.
+	Origin string `json:"origin"`
+}
+
+// enableTestdriver injects the testdriver implementation in the pages of the
+// context and executes the actions it receives.
+func enableTestdriver(ctx context.Context) error {
+	chromedp.ListenTarget(ctx, func(ev any) {
+		e, ok := ev.(*runtime.EventBindingCalled)
+		if !ok || e.Name != testdriverBinding {
+			return
+		}
+
+		// Don't block the events loop while executing the action.
+		go handleTestdriver(ctx, e.Payload)
+	})
+
+	return chromedp.Run(ctx,
+		runtime.AddBinding(testdriverBinding),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			_, err := page.AddScriptToEvaluateOnNewDocument(testdriverVendorJS).Do(ctx)
+			return err
+		}),
+	)
+}
+
+// handleTestdriver executes the action and resolves its promise in the page.
+func handleTestdriver(ctx context.Context, payload string) {
+	var a tdAction
+	if err := json.Unmarshal([]byte(payload), &a); err != nil {
+		slog.Debug("testdriver payload", slog.String("payload", payload), slog.Any("err", err))
+		return
+	}
+
+	slog.Debug("testdriver action", slog.String("action", a.Action))
+
+	var err error
+	switch a.Action {
+	case "click":
+		err = chromedp.Run(ctx, click(a.X, a.Y))
+	case "send_keys":
+		err = chromedp.Run(ctx, sendKeys(a.Keys))
+	case "action_sequence":
+		err = chromedp.Run(ctx, actionSequence(a.Actions))
+	case "set_permission":
+		if a.Descriptor == nil {
+			err = fmt.Errorf("missing permission descriptor")
+			break
+		}
+		err = chromedp.Run(ctx,
+			browser.SetPermission(a.Descriptor, a.State).WithOrigin(a.Origin),
+		)
+	default:
+		err = fmt.Errorf("unsupported testdriver action: %s", a.Action)
+	}
+
+	var msg string
+	if err != nil {
+		msg = err.Error()
+	}
+	arg, _ := json.Marshal(msg)
+
+	if err := chromedp.Run(ctx, chromedp.Evaluate(
+		fmt.Sprintf("window.__wptrunnerResolve(%d, %s)", a.ID, arg), nil,
+	)); err != nil {
+		slog.Debug("testdriver resolve", slog.Any("err", err))
+	}
+}
+
+// click dispatches a left click at the viewport coordinates.
+func click(x, y float64) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if err := input.DispatchMouseEvent(input.MouseMoved, x, y).Do(ctx); err != nil {
+			return err
+		}
+		if err := input.DispatchMouseEvent(input.MousePressed, x, y).
+			WithButton(input.Left).WithClickCount(1).Do(ctx); err != nil {
+			return err
+		}
+		return input.DispatchMouseEvent(input.MouseReleased, x, y).
+			WithButton(input.Left).WithClickCount(1).Do(ctx)
+	})
+}
+
+// tdKey describes a WebDriver special key.
+type tdKey struct {
+	key  string
+	code string
+	vk   int64
+	text string
+}
+
+// tdKeys maps the WebDriver special key code points to the DOM keys.
+var tdKeys = map[rune]tdKey{
+	'\uE003': {key: "Backspace", code: "Backspace", vk: 8},
+	'\uE004': {key: "Tab", code: "Tab", vk: 9},
+	'\uE006': {key: "Enter", code: "Enter", vk: 13, text: "\r"},
+	'\uE007': {key: "Enter", code: "Enter", vk: 13, text: "\r"},
+	'\uE008': {key: "Shift", code: "ShiftLeft", vk: 16},
+	'\uE009': {key: "Control", code: "ControlLeft", vk: 17},
+	'\uE00A': {key: "Alt", code: "AltLeft", vk: 18},
+	'\uE00C': {key: "Escape", code: "Escape", vk: 27},
+	'\uE00D': {key: " ", code: "Space", vk: 32, text: " "},
+	'\uE012': {key: "ArrowLeft", code: "ArrowLeft", vk: 37},
+	'\uE013': {key: "ArrowUp", code: "ArrowUp", vk: 38},
+	'\uE014': {key: "ArrowRight", code: "ArrowRight", vk: 39},
+	'\uE015': {key: "ArrowDown", code: "ArrowDown", vk: 40},
+	'\uE017': {key: "Delete", code: "Delete", vk: 46},
+	'\uE03D': {key: "Meta", code: "MetaLeft", vk: 91},
+}
+
+// keyOf returns the DOM key of a WebDriver key value.
+func keyOf(r rune) tdKey {
+	if k, ok := tdKeys[r]; ok {
+		return k
+	}
+	return tdKey{key: string(r), text: string(r)}
+}
+
+// dispatchKey dispatches a key down or up event.
+func dispatchKey(ctx context.Context, typ input.KeyType, k tdKey) error {
+	p := input.DispatchKeyEvent(typ).WithKey(k.key)
+	if k.code != "" {
+		p = p.WithCode(k.code)
+	}
+	if k.vk != 0 {
+		p = p.WithWindowsVirtualKeyCode(k.vk)
+	}
+	if typ == input.KeyDown && k.text != "" {
+		p = p.WithText(k.text)
+	}
+	return p.Do(ctx)
+}
+
+// sendKeys types the keys in the focused element.
+func sendKeys(keys string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		for _, r := range keys {
+			k := keyOf(r)
+			if err := dispatchKey(ctx, input.KeyDown, k); err != nil {
+				return err
+			}
+			if err := dispatchKey(ctx, input.KeyUp, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// actionSequence executes a WebDriver actions sequence: the n-th actions of
+// all the sources are executed together as the n-th tick.
+func actionSequence(sources []tdSource) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		var ticks int
+		for _, s := range sources {
+			ticks = max(ticks, len(s.Actions))
+		}
+
+		// pointer state
+		var (
+			x, y    float64
+			pressed = input.None
+		)
+
+		buttons := []input.MouseButton{input.Left, input.Middle, input.Right}
+		button := func(i int) input.MouseButton {
+			if i >= 0 && i < len(buttons) {
+				return buttons[i]
+			}
+			return input.Left
+		}
+
+		for i := range ticks {
+			var pause time.Duration
+			for _, s := range sources {
+				if i >= len(s.Actions) {
+					continue
+				}
+				a := s.Actions[i]
+
+				var err error
+				switch a.Type {
+				case "pause":
+					pause = max(pause, time.Duration(a.Duration)*time.Millisecond)
+				case "keyDown", "keyUp":
+					typ := input.KeyDown
+					if a.Type == "keyUp" {
+						typ = input.KeyUp
+					}
+					for _, r := range a.Value {
+						if err = dispatchKey(ctx, typ, keyOf(r)); err != nil {
+							break
+						}
+					}
+				case "pointerMove":
+					if a.Origin == "pointer" {
+						x, y = x+a.X, y+a.Y
+					} else {
+						x, y = a.X, a.Y
+					}
+					err = input.DispatchMouseEvent(input.MouseMoved, x, y).WithButton(pressed).Do(ctx)
+				case "pointerDown":
+					pressed = button(a.Button)
+					err = input.DispatchMouseEvent(input.MousePressed, x, y).
+						WithButton(pressed).WithClickCount(1).Do(ctx)
+				case "pointerUp":
+					err = input.DispatchMouseEvent(input.MouseReleased, x, y).
+						WithButton(button(a.Button)).WithClickCount(1).Do(ctx)
+					pressed = input.None
+				default:
+					err = fmt.Errorf("unsupported action: %s %s", s.Type, a.Type)
+				}
+				if err != nil {
+					return err
+				}
+			}
+
+			if pause > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(pause):
+				}
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Duration is a time.Duration decoded from a JSON string like "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Timeouts are the durations bounding a test run. A zero value is unset.
+type Timeouts struct {
+	// Timeout is the total duration of a test.
+	Timeout Duration `json:"timeout,omitempty"`
+	// LongTimeout is the total duration of a test with a long timeout.
+	LongTimeout Duration `json:"long_timeout,omitempty"`
+	// Grace is the max duration without subtest result before forcing the
+	// testharness timeout.
+	Grace Duration `json:"grace,omitempty"`
+	// ProbeInterval is the delay between two probes of the test progress.
+	ProbeInterval Duration `json:"probe_interval,omitempty"`
+}
+
+// Total returns the total duration of the test.
+func (t Timeouts) Total(long bool) time.Duration {
+	if long {
+		return time.Duration(t.LongTimeout)
+	}
+	return time.Duration(t.Timeout)
+}
+
+// merge overrides the durations with the ones set in o.
+func (t Timeouts) merge(o Timeouts) Timeouts {
+	if o.Timeout > 0 {
+		t.Timeout = o.Timeout
+	}
+	if o.LongTimeout > 0 {
+		t.LongTimeout = o.LongTimeout
+	}
+	if o.Grace > 0 {
+		t.Grace = o.Grace
+	}
+	if o.ProbeInterval > 0 {
+		t.ProbeInterval = o.ProbeInterval
+	}
+	return t
+}
+
+// PathTimeouts sets the timeouts of the tests matching the pattern, using
+// the include and exclude files syntax.
+type PathTimeouts struct {
+	Pattern string `json:"pattern"`
+	Timeouts
+
+	rule *Rule
+}
+
+// TimeoutConfig maps the tests to their timeouts.
+type TimeoutConfig struct {
+	Default Timeouts `json:"default"`
+	// Paths are applied in order, the last matching path wins.
+	Paths []PathTimeouts `json:"paths"`
+	// Override is set by the command line, it wins over all the others.
+	Override Timeouts `json:"-"`
+}
+
+// DefaultTimeoutConfig returns the built-in timeouts.
+func DefaultTimeoutConfig() *TimeoutConfig {
+	c := &TimeoutConfig{
+		Default: Timeouts{
+			Timeout:       Duration(CDPTimeout),
+			LongTimeout:   Duration(LongTimeout),
+			Grace:         Duration(5 * time.Second),
+			ProbeInterval: Duration(2 * time.Second),
+		},
+		Paths: []PathTimeouts{
+			// /wasm/ tests can be slow on the CI, but are known to be pass
+			{Pattern: "**/wasm/**", Timeouts: Timeouts{Grace: Duration(10 * time.Second)}},
+			// A single 100k-iteration PBKDF2 subtest can exceed the default
+			// grace on the CI; the file as a whole still finishes within its
+			// timeout.
+			{Pattern: "**/WebCryptoAPI/**", Timeouts: Timeouts{Grace: Duration(15 * time.Second)}},
+		},
+	}
+	if err := c.compile("built-in"); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// LoadTimeoutConfig reads a JSON config file on top of the built-in
+// timeouts: its defaults override the built-in ones and its paths are
+// applied after the built-in ones.
+func LoadTimeoutConfig(name string) (*TimeoutConfig, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	var file TimeoutConfig
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", name, err)
+	}
+	if err := file.compile(name); err != nil {
+		return nil, err
+	}
+
+	c := DefaultTimeoutConfig()
+	c.Default = c.Default.merge(file.Default)
+	c.Paths = append(c.Paths, file.Paths...)
+
+	return c, nil
+}
+
+// compile compiles the paths patterns.
+func (c *TimeoutConfig) compile(source string) error {
+	for i := range c.Paths {
+		p := &c.Paths[i]
+		r, err := NewRule(p.Pattern, fmt.Sprintf("%s: paths[%d]", source, i))
+		if err != nil {
+			return err
+		}
+		p.rule = r
+	}
+	return nil
+}
+
+// For returns the timeouts of the test. A nil config returns the built-in
+// timeouts.
+func (c *TimeoutConfig) For(t Test) Timeouts {
+	if c == nil {
+		c = DefaultTimeoutConfig()
+	}
+
+	tm := c.Default
+	for _, p := range c.Paths {
+		if p.rule.Match(t.URL) {
+			tm = tm.merge(p.Timeouts)
+		}
+	}
+	return tm.merge(c.Override)
+}
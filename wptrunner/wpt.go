@@ -6,17 +6,86 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
+)
+
+// Test types, as named in the manifest.
+const (
+	TypeTestharness  = "testharness"
+	TypeReftest      = "reftest"
+	TypePrintReftest = "print-reftest"
+	TypeCrashtest    = "crashtest"
 )
 
 type Test struct {
-	URL string
+	URL string `json:"url"`
 	// whether the test is expected to take long
-	Long bool
+	Long bool `json:"long,omitempty"`
+	// Type is the test type from the manifest.
+	Type string `json:"type"`
+	// Refs are the references of a reftest.
+	Refs []Ref `json:"refs,omitempty"`
+	Meta Meta  `json:"meta"`
+	// Run is the index of the run of the test with --repeat, from 1.
+	Run int `json:"run,omitempty"`
+}
+
+// Ref is a reftest reference.
+type Ref struct {
+	URL string `json:"url"`
+	// Relation is "==" if the test must match the reference, "!=" otherwise.
+	Relation string `json:"relation"`
+}
+
+// Meta is the test metadata from the manifest.
+type Meta struct {
+	// Path is the source file of the test.
+	Path string `json:"path"`
+	// Variant is the variant query of the test URL.
+	Variant string `json:"variant,omitempty"`
+	// Flags are the flags of the source file name, like https in
+	// foo.https.any.js.
+	Flags []string `json:"flags,omitempty"`
+
+	Timeout        string      `json:"timeout,omitempty"`
+	Testdriver     bool        `json:"testdriver,omitempty"`
+	JSShell        bool        `json:"jsshell,omitempty"`
+	ScriptMetadata [][2]string `json:"script_metadata,omitempty"`
+}
+
+// HasFlag returns true if the source file name contains the flag.
+func (m Meta) HasFlag(flag string) bool {
+	return slices.Contains(m.Flags, flag)
+}
+
+// Scheme returns the protocol required by the test: http, https or h2.
+func (m Meta) Scheme() string {
+	switch {
+	case m.HasFlag("h2"):
+		return "h2"
+	case m.HasFlag("https"):
+		return "https"
+	default:
+		return "http"
+	}
 }
 
-// fetchManifest request /MANIFEST.json file and extract test harness tests.
-func fetchManifest(ctx context.Context, addr string) ([]Test, error) {
+// fileFlags returns the flags of a test file name: the dot separated parts
+// between the name and the extension.
+func fileFlags(path string) []string {
+	parts := strings.Split(filepath.Base(path), ".")
+	if len(parts) <= 2 {
+		return nil
+	}
+	return parts[1 : len(parts)-1]
+}
+
+// fetchManifest request /MANIFEST.json file and extract the tests of the
+// given types.
+func fetchManifest(ctx context.Context, addr string, types []string) ([]Test, error) {
 	u, err := url.JoinPath(addr, "MANIFEST.json")
 	if err != nil {
 		return nil, fmt.Errorf("create url: %w", err)
@@ -37,11 +106,9 @@ func fetchManifest(ctx context.Context, addr string) ([]Test, error) {
 	defer resp.Body.Close()
 
 	var manifest struct {
-		Items struct {
-			Testharness map[string]json.RawMessage `json:"testharness"`
-		} `json:"items"`
-		URLBase string `json:"url_base"`
-		Version int    `json:"version"`
+		Items   map[string]map[string]json.RawMessage `json:"items"`
+		URLBase string                                `json:"url_base"`
+		Version int                                   `json:"version"`
 	}
 
 	dec := json.NewDecoder(resp.Body)
@@ -55,8 +122,10 @@ func fetchManifest(ctx context.Context, addr string) ([]Test, error) {
 	}
 
 	tests := make([]Test, 0, 37000)
-	if err := walkManifest(manifest.Items.Testharness, "", base, &tests); err != nil {
-		return nil, err
+	for _, typ := range types {
+		if err := walkManifest(manifest.Items[typ], "", base, typ, &tests); err != nil {
+			return nil, fmt.Errorf("%s: %w", typ, err)
+		}
 	}
 
 	// Keep results in same order.
@@ -67,9 +136,9 @@ func fetchManifest(ctx context.Context, addr string) ([]Test, error) {
 	return tests, nil
 }
 
-// walkManifest recursively walks the testharness directory tree.
+// walkManifest recursively walks the directory tree of a test type.
 // Leaves are entries whose value is a JSON array (not an object).
-func walkManifest(node map[string]json.RawMessage, pathPrefix, base string, tests *[]Test) error {
+func walkManifest(node map[string]json.RawMessage, pathPrefix, base, typ string, tests *[]Test) error {
 	for key, raw := range node {
 		// Determine whether this value is an object (subdirectory) or array (file entry).
 		trimmed := json.RawMessage(raw)
@@ -84,13 +153,15 @@ func walkManifest(node map[string]json.RawMessage, pathPrefix, base string, test
 			if err := json.Unmarshal(trimmed, &sub); err != nil {
 				return fmt.Errorf("unmarshal subdir %q: %w", key, err)
 			}
-			if err := walkManifest(sub, pathPrefix+"/"+key, base, tests); err != nil {
+			if err := walkManifest(sub, pathPrefix+"/"+key, base, typ, tests); err != nil {
 				return err
 			}
 
 		case '[':
 			// File entry: ["<hash>", [<url_or_null>, <opts>], ...]
 			// The array may contain multiple test variants.
+			// Reftests variants include the references:
+			// [<url_or_null>, [[<ref_url>, <relation>], ...], <opts>]
 			var entry []json.RawMessage
 			if err := json.Unmarshal(trimmed, &entry); err != nil {
 				return fmt.Errorf("unmarshal entry %q: %w", key, err)
@@ -99,10 +170,13 @@ func walkManifest(node map[string]json.RawMessage, pathPrefix, base string, test
 			filePath := pathPrefix + "/" + key
 			for _, variantRaw := range entry[1:] {
 				// Each variant is [<url_or_null>, <options_object>]
-				var variant [2]json.RawMessage
+				var variant []json.RawMessage
 				if err := json.Unmarshal(variantRaw, &variant); err != nil {
 					return fmt.Errorf("unmarshal variant for %q: %w", key, err)
 				}
+				if len(variant) < 2 {
+					return fmt.Errorf("invalid variant for %q", key)
+				}
 				var u string
 				if string(variant[0]) == "null" {
 					// Construct URL from tree path.
@@ -115,16 +189,34 @@ func walkManifest(node map[string]json.RawMessage, pathPrefix, base string, test
 					u = base + u
 				}
 
-				var opts struct {
-					Timeout string `json:"timeout"`
+				meta := Meta{
+					Path:  filePath,
+					Flags: fileFlags(filePath),
 				}
-				if err := json.Unmarshal(variant[1], &opts); err != nil {
+				if err := json.Unmarshal(variant[len(variant)-1], &meta); err != nil {
 					return fmt.Errorf("unmarshal options for %q: %w", key, err)
 				}
+				if _, q, ok := strings.Cut(u, "?"); ok {
+					meta.Variant = "?" + q
+				}
+
+				var refs []Ref
+				if len(variant) > 2 {
+					var raw [][2]string
+					if err := json.Unmarshal(variant[1], &raw); err != nil {
+						return fmt.Errorf("unmarshal references for %q: %w", key, err)
+					}
+					for _, r := range raw {
+						refs = append(refs, Ref{URL: base + strings.TrimPrefix(r[0], "/"), Relation: r[1]})
+					}
+				}
 
 				*tests = append(*tests, Test{
 					URL:  u,
-					Long: opts.Timeout == "long",
+					Long: meta.Timeout == "long",
+					Type: typ,
+					Refs: refs,
+					Meta: meta,
 				})
 			}
 		}